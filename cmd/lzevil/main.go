@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"flag"
 	"io"
@@ -14,22 +13,34 @@ func main() {
 	decompress := flag.Bool("d", false, "decompress")
 	flag.Parse()
 
+	// Errors are returned to exit after the writer has removed its temporary
+	// file.
+	if err := run(*decompress); err != nil {
+		println("Unexpected error: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(decompress bool) (err error) {
 	var reader io.Reader = os.Stdin
 	var writer io.Writer = os.Stdout
-	var inputSize int64 // For pack
 
-	if *decompress {
+	if decompress {
 		reader = lzevil.NewReader(reader)
 	} else {
-		var buf bytes.Buffer
-		buf.ReadFrom(reader)
-		reader = &buf
-		inputSize = int64(buf.Len())
-		writer = lzevil.NewWriter(writer, int(inputSize))
+		// The size header is patched if stdout is a regular file, otherwise
+		// the data is spilled to a temporary file.
+		lzw := lzevil.NewStreamWriter(writer)
+		defer func() {
+			if closeErr := lzw.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		writer = lzw
 	}
 
 	if _, err := io.Copy(writer, reader); err != nil && !errors.Is(err, io.EOF) {
-		println("Unexpected error: " + err.Error())
-		os.Exit(1)
+		return err
 	}
+	return nil
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"net"
@@ -10,7 +9,6 @@ import (
 	"time"
 
 	"github.com/ei-projects/eimaster/pkg/eimasterlib"
-	"github.com/ei-projects/eimaster/pkg/lzevil"
 	"github.com/spf13/cobra"
 )
 
@@ -34,34 +32,12 @@ var clientCmds = []*cobra.Command{
 }
 
 func getServers(addr string, nicks bool, verbose bool) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	servers, err := eimasterlib.GetServersList(addr, 0xDEADBEEF, 5*time.Second)
 	if err != nil {
-		log.Fatalf("ResolveTCPAddr failed: %s", err.Error())
+		log.Fatalf("Failed to get servers: %s", err.Error())
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		log.Fatalf("DialTCP failed: %s", err.Error())
-	}
-
-	err = binary.Write(conn, binary.LittleEndian, uint32(0xDEADBEEF))
-	if err != nil {
-		log.Fatalf("conn.Write failed: %s", err.Error())
-	}
-
-	var inputSize int32
-	err = binary.Read(conn, binary.LittleEndian, &inputSize)
-	if err != nil || inputSize < 0 || inputSize > 100000 {
-		log.Fatalf("conn.Read failed: %s", err.Error())
-	}
-
-	lzreader := lzevil.NewReader(conn)
-	var servers []eimasterlib.EIServerInfo
-	if err := eimasterlib.ReadServersList(lzreader, false, &servers); err != nil {
-		log.Fatalf("Fail to read servers: %s", err.Error())
-	}
-
-	pingServers(servers)
+	eimasterlib.PingServers(servers, 2500*time.Millisecond)
 
 	fmt.Printf(
 		"%-12s %-8s %-6s %-9s %-22v %-6s ",
@@ -181,7 +157,7 @@ func sendCommand(args []string) {
 
 	var buf bytes.Buffer
 	eimasterlib.WriteGameInfo(&buf, false, &game)
-	log.Debugf("Sending fake game:\n%s", getHexDump(buf.Bytes()))
+	log.Debugf("Sending fake game:\n%s", eimasterlib.HexDump(buf.Bytes()))
 
 	n, err := conn.Write(buf.Bytes())
 	if n < buf.Len() || err != nil {
@@ -193,7 +169,7 @@ func sendCommand(args []string) {
 	if n == 0 || err != nil {
 		log.Fatalf("Master server hasn't answered: %s, %d", err, n)
 	}
-	log.Debugf("Response from master:\n%s", getHexDump(recvBuf[:n]))
+	log.Debugf("Response from master:\n%s", eimasterlib.HexDump(recvBuf[:n]))
 
 	err = eimasterlib.ReadMasterResponse(bytes.NewReader(recvBuf), &game)
 	if err != nil {
@@ -203,7 +179,7 @@ func sendCommand(args []string) {
 
 	buf.Reset()
 	eimasterlib.WriteGameInfo(&buf, *nicksFlag, &game)
-	log.Debugf("Sending fake game again with password:\n%s", getHexDump(buf.Bytes()))
+	log.Debugf("Sending fake game again with password:\n%s", eimasterlib.HexDump(buf.Bytes()))
 	n, err = conn.Write(buf.Bytes())
 	if n < buf.Len() || err != nil {
 		log.Fatalf("conn.Write failed: %s. %d bytes were written", err, n)
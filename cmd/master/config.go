@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ei-projects/eimaster/pkg/masterserver"
+	"github.com/spf13/cobra"
+)
+
+// duration is time.Duration which is written in config as a string like "15s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\": %w", err)
+	}
+	val, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = duration(val)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// serverConfig is the config file of `server run`. Flags set explicitly
+// override the values from the file.
+type serverConfig struct {
+	Addr       string `json:"addr"`
+	HTTPAddr   string `json:"http_addr"`
+	HTTPPrefix string `json:"http_prefix"`
+	AdminAddr  string `json:"admin_addr"`
+	State      string `json:"state"`
+	Registry   string `json:"registry"`
+	History    string `json:"history"`
+	Moderation string `json:"moderation"`
+	AuditLog   string `json:"audit_log"`
+	AdminToken string `json:"admin_token"`
+
+	RefreshInterval  duration `json:"refresh_interval"`
+	VisibleFor       duration `json:"visible_for"`
+	ExpireAfter      duration `json:"expire_after"`
+	PingTimeout      duration `json:"ping_timeout"`
+	PingInterval     duration `json:"ping_interval"`
+	PingMaxInterval  duration `json:"ping_max_interval"`
+	ClientIDTimeout  duration `json:"client_id_timeout"`
+	WriteTimeout     duration `json:"write_timeout"`
+	SendDelay        duration `json:"send_delay"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+
+	PacketRate          float64 `json:"packet_rate"`
+	PacketBurst         int     `json:"packet_burst"`
+	MaxServersPerIP     int     `json:"max_servers_per_ip"`
+	MaxServersPerSubnet int     `json:"max_servers_per_subnet"`
+	MaxServers          int     `json:"max_servers"`
+	MaxCopies           int     `json:"max_copies"`
+	EvictionPolicy      string  `json:"eviction_policy"`
+	StrictTokens        bool    `json:"strict_tokens"`
+
+	PeerName         string   `json:"peer_name"`
+	Peers            []string `json:"peers"`
+	PeerToken        string   `json:"peer_token"`
+	PeerSyncInterval duration `json:"peer_sync_interval"`
+	PeerMaxHops      int      `json:"peer_max_hops"`
+
+	Mirrors        []string `json:"mirrors"`
+	MirrorInterval duration `json:"mirror_interval"`
+	MirrorTTL      duration `json:"mirror_ttl"`
+
+	MaxEndpoints int `json:"max_endpoints"`
+
+	MaxNameLength  int      `json:"max_name_length"`
+	MaxQuestLength int      `json:"max_quest_length"`
+	MaxNickLength  int      `json:"max_nick_length"`
+	WordLists      []string `json:"word_lists"` // Files with banned words
+	ContentPolicy  string   `json:"content_policy"`
+
+	// bannedWords are read from WordLists by loadServerConfig.
+	bannedWords []string
+
+	// Zero values mean defaults of the server
+	UDPSockets    int `json:"udp_sockets"`
+	PacketWorkers int `json:"packet_workers"`
+	PacketQueue   int `json:"packet_queue"`
+	ListWorkers   int `json:"list_workers"`
+	ListQueue     int `json:"list_queue"`
+	PingQueue     int `json:"ping_queue"`
+}
+
+func defaultServerConfig() serverConfig {
+	def := masterserver.DefaultConfig()
+	return serverConfig{
+		Addr:       ":28004",
+		HTTPPrefix: "/",
+
+		RefreshInterval:  duration(def.RefreshInterval),
+		VisibleFor:       duration(def.VisibleFor),
+		ExpireAfter:      duration(def.ExpireAfter),
+		PingTimeout:      duration(def.PingTimeout),
+		PingInterval:     duration(def.PingInterval),
+		PingMaxInterval:  duration(def.PingMaxInterval),
+		ClientIDTimeout:  duration(def.ClientIDTimeout),
+		WriteTimeout:     duration(def.WriteTimeout),
+		SendDelay:        duration(def.SendDelay),
+		SnapshotInterval: duration(def.SnapshotInterval),
+
+		PacketRate:          def.PacketRate,
+		PacketBurst:         def.PacketBurst,
+		MaxServersPerIP:     def.MaxServersPerIP,
+		MaxServersPerSubnet: def.MaxServersPerSubnet,
+		MaxServers:          def.MaxServers,
+		MaxCopies:           def.MaxCopies,
+		EvictionPolicy:      def.EvictionPolicy,
+
+		PeerSyncInterval: duration(def.PeerSyncInterval),
+		PeerMaxHops:      def.PeerMaxHops,
+
+		MirrorInterval: duration(def.MirrorInterval),
+		MirrorTTL:      duration(def.MirrorTTL),
+
+		MaxEndpoints: def.MaxEndpoints,
+
+		MaxNameLength:  def.MaxNameLength,
+		MaxQuestLength: def.MaxQuestLength,
+		MaxNickLength:  def.MaxNickLength,
+		ContentPolicy:  def.ContentPolicy,
+	}
+}
+
+// loadServerConfig reads the config file without validation. Values missing in
+// the file are defaults. Empty path means there is no config file.
+func loadServerConfig(path string) (serverConfig, error) {
+	cfg := defaultServerConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, listPath := range cfg.WordLists {
+		words, err := masterserver.LoadWordList(listPath)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read word list: %w", err)
+		}
+		cfg.bannedWords = append(cfg.bannedWords, words...)
+	}
+	return cfg, nil
+}
+
+// applyFlags overrides config values by the flags set in command line.
+func (cfg *serverConfig) applyFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	strFlags := map[string]*string{
+		"addr":        &cfg.Addr,
+		"http-addr":   &cfg.HTTPAddr,
+		"http-prefix": &cfg.HTTPPrefix,
+		"admin-addr":  &cfg.AdminAddr,
+		"state":       &cfg.State,
+		"registry":    &cfg.Registry,
+		"history":     &cfg.History,
+		"moderation":  &cfg.Moderation,
+		"audit-log":   &cfg.AuditLog,
+		"peer-name":   &cfg.PeerName,
+	}
+	for name, val := range strFlags {
+		if flags.Changed(name) {
+			*val, _ = flags.GetString(name)
+		}
+	}
+	if flags.Changed("peer") {
+		cfg.Peers, _ = flags.GetStringArray("peer")
+	}
+	if flags.Changed("mirror") {
+		cfg.Mirrors, _ = flags.GetStringArray("mirror")
+	}
+}
+
+// registryBackend returns the registry to use. If it's not set, it's the file
+// registry when the state path is set and the memory one otherwise.
+func (cfg *serverConfig) registryBackend() string {
+	if cfg.Registry != "" {
+		return cfg.Registry
+	}
+	if cfg.State != "" {
+		return "file"
+	}
+	return "memory"
+}
+
+func (cfg *serverConfig) validate() error {
+	switch cfg.registryBackend() {
+	case "memory":
+		// Otherwise the server would persist the registry to the state anyway.
+		if cfg.State != "" {
+			return fmt.Errorf("memory registry isn't saved, use file registry with state path")
+		}
+	case "file":
+		if cfg.State == "" {
+			return fmt.Errorf("file registry requires state path to be set")
+		}
+	default:
+		return fmt.Errorf("unknown registry %q", cfg.registryBackend())
+	}
+	if cfg.History != "" && cfg.State == "" {
+		// History is keyed by server IDs which are persisted with the state.
+		return fmt.Errorf("history requires state path to be set")
+	}
+	for name, val := range cfg.poolSizes() {
+		if val < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	srvCfg := cfg.serverConfig()
+	return srvCfg.Validate()
+}
+
+// serverConfig returns the settings which can be applied to a running server.
+func (cfg *serverConfig) serverConfig() masterserver.Config {
+	return masterserver.Config{
+		RefreshInterval:  time.Duration(cfg.RefreshInterval),
+		VisibleFor:       time.Duration(cfg.VisibleFor),
+		ExpireAfter:      time.Duration(cfg.ExpireAfter),
+		PingTimeout:      time.Duration(cfg.PingTimeout),
+		PingInterval:     time.Duration(cfg.PingInterval),
+		PingMaxInterval:  time.Duration(cfg.PingMaxInterval),
+		ClientIDTimeout:  time.Duration(cfg.ClientIDTimeout),
+		WriteTimeout:     time.Duration(cfg.WriteTimeout),
+		SendDelay:        time.Duration(cfg.SendDelay),
+		SnapshotInterval: time.Duration(cfg.SnapshotInterval),
+
+		PacketRate:          cfg.PacketRate,
+		PacketBurst:         cfg.PacketBurst,
+		MaxServersPerIP:     cfg.MaxServersPerIP,
+		MaxServersPerSubnet: cfg.MaxServersPerSubnet,
+		MaxServers:          cfg.MaxServers,
+		MaxCopies:           cfg.MaxCopies,
+		EvictionPolicy:      cfg.EvictionPolicy,
+		StrictTokens:        cfg.StrictTokens,
+
+		PeerSyncInterval: time.Duration(cfg.PeerSyncInterval),
+		PeerMaxHops:      cfg.PeerMaxHops,
+
+		MirrorInterval: time.Duration(cfg.MirrorInterval),
+		MirrorTTL:      time.Duration(cfg.MirrorTTL),
+
+		MaxEndpoints: cfg.MaxEndpoints,
+
+		MaxNameLength:  cfg.MaxNameLength,
+		MaxQuestLength: cfg.MaxQuestLength,
+		MaxNickLength:  cfg.MaxNickLength,
+		BannedWords:    cfg.bannedWords,
+		ContentPolicy:  cfg.ContentPolicy,
+	}
+}
+
+func (cfg *serverConfig) poolSizes() map[string]int {
+	return map[string]int{
+		"udp_sockets":    cfg.UDPSockets,
+		"packet_workers": cfg.PacketWorkers,
+		"packet_queue":   cfg.PacketQueue,
+		"list_workers":   cfg.ListWorkers,
+		"list_queue":     cfg.ListQueue,
+		"ping_queue":     cfg.PingQueue,
+	}
+}
+
+// options returns the options to create a server.
+func (cfg *serverConfig) options() (masterserver.Options, error) {
+	opts := masterserver.Options{
+		Addr:       cfg.Addr,
+		HTTPAddr:   cfg.HTTPAddr,
+		HTTPPrefix: cfg.HTTPPrefix,
+		AdminAddr:  cfg.AdminAddr,
+		Config:     cfg.serverConfig(),
+		Logger:     log,
+
+		HistoryPath: cfg.History,
+
+		ModerationPath: cfg.Moderation,
+		AuditLogPath:   cfg.AuditLog,
+		AdminToken:     cfg.AdminToken,
+
+		UDPSockets:    cfg.UDPSockets,
+		PacketWorkers: cfg.PacketWorkers,
+		PacketQueue:   cfg.PacketQueue,
+		ListWorkers:   cfg.ListWorkers,
+		ListQueue:     cfg.ListQueue,
+		PingQueue:     cfg.PingQueue,
+
+		PeerName:  cfg.PeerName,
+		Peers:     cfg.Peers,
+		PeerToken: cfg.PeerToken,
+
+		Mirrors: cfg.Mirrors,
+	}
+	if cfg.registryBackend() == "file" {
+		// File registry persists itself, so the state is stored by the
+		// registry instead of the server. Memory registry has no state, see
+		// validate.
+		reg, err := masterserver.NewFileRegistry(cfg.State)
+		if err != nil {
+			return opts, fmt.Errorf("failed to open registry: %w", err)
+		}
+		opts.Registry = reg
+	}
+	return opts, nil
+}
+
+// restartRequired returns the names of the changed settings which can't be
+// applied without restart.
+func (cfg *serverConfig) restartRequired(newCfg *serverConfig) []string {
+	var names []string
+	fields := []struct {
+		name     string
+		old, new string
+	}{
+		{"addr", cfg.Addr, newCfg.Addr},
+		{"http_addr", cfg.HTTPAddr, newCfg.HTTPAddr},
+		{"http_prefix", cfg.HTTPPrefix, newCfg.HTTPPrefix},
+		{"admin_addr", cfg.AdminAddr, newCfg.AdminAddr},
+		{"state", cfg.State, newCfg.State},
+		{"registry", cfg.registryBackend(), newCfg.registryBackend()},
+		{"history", cfg.History, newCfg.History},
+		{"moderation", cfg.Moderation, newCfg.Moderation},
+		{"audit_log", cfg.AuditLog, newCfg.AuditLog},
+		{"admin_token", cfg.AdminToken, newCfg.AdminToken},
+		{"peer_name", cfg.PeerName, newCfg.PeerName},
+		{"peers", strings.Join(cfg.Peers, " "), strings.Join(newCfg.Peers, " ")},
+		{"peer_token", cfg.PeerToken, newCfg.PeerToken},
+		{"mirrors", strings.Join(cfg.Mirrors, " "), strings.Join(newCfg.Mirrors, " ")},
+	}
+	for _, f := range fields {
+		if f.old != f.new {
+			names = append(names, f.name)
+		}
+	}
+	oldSizes, newSizes := cfg.poolSizes(), newCfg.poolSizes()
+	var changedSizes []string
+	for name, val := range oldSizes {
+		if newSizes[name] != val {
+			changedSizes = append(changedSizes, name)
+		}
+	}
+	sort.Strings(changedSizes)
+	return append(names, changedSizes...)
+}
@@ -1,414 +1,139 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	golog "log"
-	"math/rand"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
-	"time"
 
-	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
-	"github.com/ei-projects/eimaster/pkg/lzevil"
+	"github.com/ei-projects/eimaster/pkg/masterserver"
 	"github.com/spf13/cobra"
 )
 
-var (
-	serverMainAddr   = "0.0.0.0:28004"
-	serverHttpAddr   = ""
-	serverHttpPrefix = "/"
-	serverState      = ""
-)
-
 var runCmd = cobra.Command{
 	Use:   "run",
 	Short: "Run master server",
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		serverMainAddr, _ = cmd.Flags().GetString("addr")
-		serverHttpAddr, _ = cmd.Flags().GetString("http-addr")
-		serverHttpPrefix, _ = cmd.Flags().GetString("http-prefix")
-		serverState, _ = cmd.Flags().GetString("state")
-		serverMainLoop()
+		cfgPath, _ := cmd.Flags().GetString("config")
+		cfg, err := loadConfig(cmd, cfgPath)
+		if err != nil {
+			log.Fatalf("Invalid config: %s", err)
+		}
+		if err := serverMainLoop(cmd, cfgPath, cfg); err != nil {
+			log.Fatalf("Server failed: %s", err)
+		}
 	},
 }
-var serverCmds = []*cobra.Command{&runCmd}
-
-var (
-	servUpdates = make(chan *master.EIServerInfo, 100)
-	servLists   = make(chan []master.EIServerInfo)
-)
 
-func init() {
-	runCmd.Flags().String("addr", serverMainAddr, "Set server address")
-	runCmd.Flags().String("http-addr", serverHttpAddr,
-		"Set http server address. Don't serve if not set or empty")
-	runCmd.Flags().String("http-prefix", serverHttpPrefix, "Prefix for http servers")
-	runCmd.Flags().String("state", "", "Path to state file")
+var configCmd = cobra.Command{
+	Use:   "config",
+	Short: "Server config commands",
 }
 
-func handleServerInfo(pc net.PacketConn, addr net.Addr, data []byte) {
-	log.Debugf("Data recieved %d bytes from %s", len(data), addr)
-
-	udpAddr, ok := addr.(*net.UDPAddr)
-	if !ok || udpAddr == nil {
-		log.Errorf("Failed to cast addr %s to UDPAddr", addr)
-	}
-
-	srv := master.EIServerInfo{
-		Addr:       *udpAddr,
-		AppearTime: time.Now(),
-		LastUpdate: time.Now(),
-	}
-
-	r := bytes.NewReader(data)
-	err := master.ReadGameInfo(r, false, &srv.EIGameInfo)
-	if err != nil {
-		log.Errorf("Failed to parse game info: %s, hex dump:\n%s",
-			err.Error(), getHexDump(data))
-		return
-	}
-	if r.Len() > 0 {
-		// Some data remaining. Probably it's nicks
-		r.Reset(data)
-		err = master.ReadGameInfo(r, true, &srv.EIGameInfo)
+var configCheckCmd = cobra.Command{
+	Use:   "check <file>",
+	Short: "Validate server config file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadServerConfig(args[0])
+		if err == nil {
+			err = cfg.validate()
+		}
 		if err != nil {
-			log.Errorf("Failed to parse game info: %s, hex dump:\n%s",
-				err.Error(), getHexDump(data))
-			return
+			log.Fatalf("Invalid config: %s", err)
 		}
-	}
-
-	jsonData, _ := json.Marshal(&srv)
-	log.Infof("Received game from: %s", string(jsonData))
-
-	if srv.MasterToken == 0 && srv.IsSentByOrigGame() {
-		srv.MasterToken = 1 + uint32(rand.Int63n(0xFFFFFFFE))
-		log.Debugf("Sending password %08X to %s", srv.MasterToken, &srv)
-		var buf bytes.Buffer
-		master.WriteMasterResponse(&buf, &srv.EIGameInfo)
-		pc.WriteTo(buf.Bytes(), addr)
-	}
-
-	servUpdates <- &srv
+		println("Config is valid")
+	},
 }
 
-func serversReciever(ctx context.Context) error {
-	pc, err := net.ListenPacket("udp", serverMainAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen udp:%s: %w", serverMainAddr, err)
-	}
-	defer pc.Close()
-
-	log.Infof("Listening on udp:%s", serverMainAddr)
-
-	doneChan := make(chan error, 1)
-	go func() {
-		buffer := make([]uint8, 4096)
-		for {
-			n, addr, err := pc.ReadFrom(buffer)
-			if err != nil {
-				doneChan <- err
-				return
-			}
+var serverCmds = []*cobra.Command{&runCmd, &configCmd}
 
-			data := make([]byte, n)
-			copy(data, buffer[:n])
-			go handleServerInfo(pc, addr, data)
-		}
-	}()
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err = <-doneChan:
-		return err
-	}
+func init() {
+	def := defaultServerConfig()
+	runCmd.Flags().String("config", "", "Path to config file")
+	runCmd.Flags().String("addr", def.Addr, "Set server address")
+	runCmd.Flags().String("http-addr", def.HTTPAddr,
+		"Set http server address. Don't serve if not set or empty")
+	runCmd.Flags().String("http-prefix", def.HTTPPrefix, "Prefix for http servers")
+	runCmd.Flags().String("admin-addr", def.AdminAddr,
+		"Set admin http server address. Admin endpoints are served by http server if empty")
+	runCmd.Flags().String("state", def.State, "Path to state file of file registry")
+	runCmd.Flags().String("registry", def.Registry,
+		"Registry backend: memory or file. File registry is stored at --state path, memory one isn't saved. "+
+			"File registry is used by default if --state is set")
+	runCmd.Flags().String("history", def.History,
+		"Path to player count history file. History is not saved if empty, it requires --state")
+	runCmd.Flags().String("moderation", def.Moderation,
+		"Path to moderation file with bans and server marks. They are not saved if empty")
+	runCmd.Flags().String("audit-log", def.AuditLog, "Path to audit log of moderation actions")
+	runCmd.Flags().String("peer-name", def.PeerName,
+		"Name of this master for peers. Host name is used if empty")
+	runCmd.Flags().StringArray("peer", def.Peers,
+		"Base URL of admin endpoints of peer master to sync with. May be repeated")
+	runCmd.Flags().StringArray("mirror", def.Mirrors,
+		"Address of upstream master to copy servers list from. May be repeated")
+
+	configCmd.AddCommand(&configCheckCmd)
 }
 
-func sendServersInfo(conn net.Conn) {
-	defer conn.Close()
-
-	var data [4]byte
-	var clientID uint32
-	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-	_, err := io.ReadFull(conn, data[:])
-	if err != nil {
-		log.Warnf("Client %s hasn't sent its ID before requesting server list: %s",
-			conn.RemoteAddr(), err)
-	} else {
-		binary.Read(bytes.NewReader(data[:]), binary.LittleEndian, &clientID)
-	}
-
-	servList := <-servLists
-	log.Infof("Client addr: %s id: %08X connected. Sending %d servers...\n",
-		conn.RemoteAddr(), clientID, len(servList))
-
-	// Serialize servers list
-	var buf1, buf2 bytes.Buffer
-	master.WriteServersList(&buf1, false, servList)
-	w := lzevil.NewWriter(&buf2, buf1.Len())
-	w.Write(buf1.Bytes())
-
-	buf1.Reset()
-	binary.Write(&buf1, binary.LittleEndian, uint32(buf2.Len()+4))
-	buf1.Write(buf2.Bytes())
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	_, err = io.Copy(conn, &buf1)
+// loadConfig reads the config file and applies command line flags to it.
+func loadConfig(cmd *cobra.Command, path string) (serverConfig, error) {
+	cfg, err := loadServerConfig(path)
 	if err != nil {
-		log.Warnf("Failed to send servers list to %s: %s", conn.RemoteAddr(), err)
-		return
+		return cfg, err
 	}
-
-	// The game needs this delay for some reason... Test client works fine without it
-	time.Sleep(100 * time.Millisecond)
+	cfg.applyFlags(cmd)
+	return cfg, cfg.validate()
 }
 
-func serversSender(ctx context.Context) error {
-	listener, err := net.Listen("tcp", serverMainAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on tcp addr %s: %w", serverMainAddr, err)
-	}
-	defer listener.Close()
-
-	log.Infof("Listening on tcp:%s", serverMainAddr)
+func serverMainLoop(cmd *cobra.Command, cfgPath string, cfg serverConfig) error {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	doneChan := make(chan error, 1)
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				doneChan <- err
-				return
-			}
-			go sendServersInfo(conn)
-		}
-	}()
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err = <-doneChan:
+	opts, err := cfg.options()
+	if err != nil {
 		return err
 	}
-}
-
-func serversSenderJSON(ctx context.Context) error {
-	handler := http.NewServeMux()
-	handler.HandleFunc(serverHttpPrefix, func(w http.ResponseWriter, req *http.Request) {
-		data, err := json.Marshal(<-servLists)
-		if err != nil {
-			log.Errorf("Failed to convert server list to JSON: %s", err)
-			return
-		}
-
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/json")
-		_, err = w.Write((data))
-		if err != nil {
-			log.Errorf("Failed write HTTP response: %s", err)
-			return
-		}
-	})
-
-	logWriter := log.Writer()
-	defer logWriter.Close()
-	server := http.Server{
-		Addr:              serverHttpAddr,
-		ErrorLog:          golog.New(logWriter, "", 0),
-		Handler:           handler,
-		ReadHeaderTimeout: 10 * time.Second,
-	}
-
-	doneChan := make(chan error, 1)
-	go func() {
-		log.Infof("Listening on http:%s", server.Addr)
-		doneChan <- server.ListenAndServe()
-	}()
-
-	select {
-	case <-ctx.Done():
-		server.Shutdown(context.Background())
-		return ctx.Err()
-	case err := <-doneChan:
+	srv := masterserver.New(opts)
+	if err := srv.Start(context.Background()); err != nil {
 		return err
 	}
-}
-
-func findServer(target *master.EIServerInfo, servList []*master.EIServerInfo) *master.EIServerInfo {
-	// First try to find server with strict equality.
-	for _, srv := range servList {
-		if srv.StrictEquals(target) {
-			return srv
-		}
-	}
-	// Then try to find server with similar parameters.
-	for _, srv := range servList {
-		if srv.Equals(target) {
-			return srv
-		}
-	}
-	return nil
-}
-
-func maintainServerList(ctx context.Context) error {
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-
-	// Run pinger
-	pingsChan := make(chan *master.EIServerInfo, 100)
-	pingsUpdates := make(chan *master.EIServerInfo, 100)
-	defer close(pingsChan)
-	go func() {
-		for srv := range pingsChan {
-			go func(srv *master.EIServerInfo) {
-				pingServer(srv, 2500*time.Millisecond)
-				pingsUpdates <- srv
-			}(srv)
-		}
-		for range pingsUpdates {
-			// Just consume remaining ping updates
-		}
-	}()
-
-	servList := make([]*master.EIServerInfo, 0)
-	servListToSend := make([]master.EIServerInfo, 0)
-
-	// Load state from file if it exists and save it on exit.
-	if serverState != "" {
-		err := loadDataFromGOB(serverState, &servList)
-		if err != nil {
-			log.Errorf("Failed to load state: %s", err)
-		}
-
-		defer func() {
-			err := saveDataToGOB(serverState, &servList)
-			if err != nil {
-				log.Errorf("Failed to save state: %s", err)
-			}
-		}()
-	}
 
+loop:
 	for {
 		select {
-		case <-ticker.C:
-			curTime := time.Now()
-			newServList := make([]*master.EIServerInfo, 0, len(servList))
-			newServListToSend := make([]master.EIServerInfo, 0, len(servList))
-			for _, srv := range servList {
-				if curTime.Sub(srv.LastUpdate) > 30*time.Minute {
-					log.Debugf("Server %s hasn't sent updates for 30 min, removing...", srv)
-				} else if curTime.Sub(srv.LastUpdate) > 2*time.Minute {
-					// This server is a candidate to remove. Let's keep it for some time.
-					// But don't send it
-					newServList = append(newServList, srv)
-				} else {
-					newServList = append(newServList, srv)
-					newServListToSend = append(newServListToSend, *srv.Copy())
-				}
+		case sig := <-c:
+			if sig != syscall.SIGHUP {
+				log.Infof("Got signal: %v. Stopping server", sig)
+				break loop
 			}
-			servList = newServList
-			servListToSend = newServListToSend
-			log.Debugf("Servers list were refreshed: running: %d, visible: %d...",
-				len(servList), len(servListToSend))
-
-		case updSrv := <-servUpdates:
-			existingSrv := findServer(updSrv, servList)
-			pingsChan <- updSrv.Copy()
-
-			if existingSrv == nil {
-				log.Debugf("Received new server: %s", updSrv)
-				servList = append(servList, updSrv)
-			} else {
-				log.Debugf("Received update for existing server: %s", updSrv)
-				// Reuse some parameters from existing server
-				updSrv.AppearTime = existingSrv.AppearTime
-				updSrv.Ping = existingSrv.Ping
-				updSrv.LastSuccessfulPing = existingSrv.LastSuccessfulPing
-				if time.Since(existingSrv.LastSuccessfulPing) < 2*time.Minute {
-					// Keep address from existing server if it was pingable.
-					updSrv.Addr = existingSrv.Addr
-				}
-				if updSrv.IsSentByOrigGame() {
-					updSrv.PlayerNames = existingSrv.PlayerNames
-				}
-				*existingSrv = *updSrv
+			if cfgPath == "" {
+				log.Warn("Got SIGHUP, but there is no config file to reload")
+				continue
 			}
 
-		case updSrv := <-pingsUpdates:
-			existingSrv := findServer(updSrv, servList)
-			if existingSrv == nil {
-				break
+			log.Infof("Got SIGHUP. Reloading config %s", cfgPath)
+			newCfg, err := loadConfig(cmd, cfgPath)
+			if err == nil {
+				err = srv.SetConfig(newCfg.serverConfig())
 			}
-
-			if updSrv.Ping > 0 {
-				existingSrv.LastSuccessfulPing = time.Now()
+			if err != nil {
+				log.Errorf("Failed to reload config: %s", err)
+				continue
 			}
-
-			if existingSrv.Addr.String() == updSrv.Addr.String() {
-				existingSrv.Ping = updSrv.Ping
-			} else if updSrv.Ping > 0 &&
-				(existingSrv.Ping <= 0 || existingSrv.Ping > updSrv.Ping) {
-				// Existing addr is not pingable or its ping worse than new one.
-				existingSrv.Addr = updSrv.Addr
-				existingSrv.Ping = updSrv.Ping
+			if names := cfg.restartRequired(&newCfg); len(names) > 0 {
+				log.Warnf("Changes of %s require restart, they are not applied",
+					strings.Join(names, ", "))
 			}
-
-		case servLists <- servListToSend:
-			log.Debugf("Sending %d servers", len(servListToSend))
-
-		case <-ctx.Done():
-			return ctx.Err()
+		case <-srv.Done():
+			break loop
 		}
 	}
-}
-
-func serverMainLoop() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		sig := <-c
-		log.Infof("Got signal: %v. Stopping server", sig)
-		cancel()
-	}()
-
-	var wg sync.WaitGroup
-	startWorker := func(name string, f func(ctx context.Context) error) {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := f(ctx)
-			if errors.Is(err, context.Canceled) {
-				log.Debugf("%s cancelled", name)
-			} else {
-				log.Errorf("%s failed: %s", name, err)
-				cancel()
-			}
-		}()
-	}
 
-	startWorker("Reciever", serversReciever)
-	startWorker("Sender", serversSender)
-	if serverHttpAddr != "" {
-		startWorker("SenderJSON", serversSenderJSON)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		return err
 	}
-	startWorker("Maintainer", maintainServerList)
-
-	log.Info("Server started")
-	<-ctx.Done()
-
-	log.Info("Server is stopping...")
-	wg.Wait()
-
-	log.Info("Server stopped")
+	return srv.Err()
 }
@@ -13,6 +13,14 @@ import (
 const eiProtoMagic uint32 = 0xDEC0AD07
 const eiNicksMagic uint32 = 0xDEADBEEF
 
+// afInet is the address family of IPv4 addresses in the game protocol. The
+// protocol has no room for IPv6 addresses.
+const afInet = 2
+
+// ErrNoIPv4 is returned if the address can't be sent to the game because it's
+// neither IPv4 nor IPv4-mapped IPv6 address.
+var ErrNoIPv4 = errors.New("address is not IPv4")
+
 // EIServerAddr represents server address. Maybe it makes sense to get rid of this
 // and use net.Addr instead
 type EIServerAddr struct {
@@ -32,25 +40,72 @@ type EIGameInfo struct {
 	PlayerNames     []string `json:"player_names,omitempty"`
 }
 
+// EIServerEndpoint is an address the game server has sent updates from. Every
+// endpoint is pinged on its own.
+type EIServerEndpoint struct {
+	Addr               net.UDPAddr `json:"addr"`
+	FirstSeen          time.Time   `json:"first_seen"`
+	LastSeen           time.Time   `json:"last_seen"` // Time of the last update from the address
+	PingStats          PingStats   `json:"ping_stats"`
+	LastSuccessfulPing time.Time   `json:"last_successful_ping"`
+}
+
 type EIServerInfo struct {
+	ID   uint64      `json:"id"` // Assigned by master server, unique within its registry
 	Addr net.UDPAddr `json:"addr"`
 	EIGameInfo
 	AppearTime         time.Time `json:"appear_time"`
 	LastUpdate         time.Time `json:"last_update"`
-	Ping               int       `json:"ping"`
+	Ping               int       `json:"ping"` // Rounded PingStats.RTT, kept for old clients
+	PingStats          PingStats `json:"ping_stats"`
 	LastSuccessfulPing time.Time `json:"last_successful_ping"`
+	// TokenVerified is set if the last update echoed MasterToken issued by
+	// master server to this game server.
+	TokenVerified bool `json:"token_verified"`
+	// Origin is the name of master server the game server is registered on
+	// and OriginID is its ID there. Origin is empty for local servers. Hops is
+	// the number of masters the entry has been relayed through.
+	Origin   string `json:"origin,omitempty"`
+	OriginID uint64 `json:"origin_id,omitempty"`
+	Hops     int    `json:"hops,omitempty"`
+	// Mirror is the address of upstream master server the entry is copied
+	// from. It's empty for servers registered on this master or its peers.
+	Mirror string `json:"mirror,omitempty"`
+	// Tags and Pinned are set by moderators of master server. Pinned servers
+	// are listed first in ascending order of Pinned, 0 means not pinned.
+	Tags   []string `json:"tags,omitempty"`
+	Pinned int      `json:"pinned,omitempty"`
+	// Endpoints are candidate addresses of the game server. Addr and ping
+	// fields above are of the one chosen by master server.
+	Endpoints []EIServerEndpoint `json:"endpoints,omitempty"`
 }
 
+// NormalizeUDPAddr returns the address with IPv4-mapped IPv6 address replaced
+// by IPv4 one, as dual-stack sockets report IPv4 peers. Other addresses are
+// returned as is.
+func NormalizeUDPAddr(addr *net.UDPAddr) net.UDPAddr {
+	result := *addr
+	if ip := addr.IP.To4(); ip != nil {
+		result.IP, result.Zone = ip, ""
+	}
+	return result
+}
+
+// NewEIServerAddr converts the address to the game format. ErrNoIPv4 is
+// returned for IPv6 addresses.
 func NewEIServerAddr(addr *net.UDPAddr) (eiAddr *EIServerAddr, err error) {
+	if addr.Port < 0 || addr.Port > 65535 {
+		return nil, fmt.Errorf("UDPAddr %s is invalid", addr)
+	}
 	ip := addr.IP.To4()
-	if ip == nil || addr.Port < 0 || addr.Port > 65535 {
-		return nil, fmt.Errorf("UDPAddr %s is invalid or not supported", addr)
+	if ip == nil {
+		return nil, fmt.Errorf("UDPAddr %s is not supported: %w", addr, ErrNoIPv4)
 	}
 
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, uint16(addr.Port))
 	eiAddr = &EIServerAddr{
-		Family: 2,
+		Family: afInet,
 		Data:   [14]byte{buf.Bytes()[0], buf.Bytes()[1], ip[0], ip[1], ip[2], ip[3]},
 	}
 	return
@@ -74,9 +129,10 @@ func (addr *EIServerAddr) String() string {
 	return addr.GetUDPAddr().String()
 }
 
+// GetUDPAddr returns the address, nil if its family isn't supported.
 func (addr *EIServerAddr) GetUDPAddr() *net.UDPAddr {
-	if addr.Family == 2 {
-		ip := net.IPv4(addr.Data[2], addr.Data[3], addr.Data[4], addr.Data[5])
+	if addr.Family == afInet {
+		ip := net.IPv4(addr.Data[2], addr.Data[3], addr.Data[4], addr.Data[5]).To4()
 		port := binary.BigEndian.Uint16(addr.Data[0:])
 		return &net.UDPAddr{IP: ip, Port: int(port)}
 	}
@@ -101,9 +157,22 @@ func (game *EIGameInfo) IsSentByOrigGame() bool {
 func (srv *EIServerInfo) Copy() *EIServerInfo {
 	result := *srv
 	result.EIGameInfo = *result.EIGameInfo.Copy()
+	if srv.Endpoints != nil {
+		result.Endpoints = append([]EIServerEndpoint(nil), srv.Endpoints...)
+	}
 	return &result
 }
 
+// Endpoint returns the endpoint with the address, nil if there is none.
+func (srv *EIServerInfo) Endpoint(addr *net.UDPAddr) *EIServerEndpoint {
+	for i := range srv.Endpoints {
+		if srv.Endpoints[i].Addr.String() == addr.String() {
+			return &srv.Endpoints[i]
+		}
+	}
+	return nil
+}
+
 func (srv *EIServerInfo) IP() string {
 	host, _, err := net.SplitHostPort(srv.Addr.String())
 	if err != nil {
@@ -117,7 +186,7 @@ func (srv *EIServerInfo) String() string {
 }
 
 func (srv *EIServerInfo) StrictEquals(srv2 *EIServerInfo) bool {
-	sameAddr := srv.Addr.String() == srv2.Addr.String()
+	sameAddr := srv.Addr.String() == srv2.Addr.String() || srv.Endpoint(&srv2.Addr) != nil
 	sameClientID := srv.ClientID == srv2.ClientID
 	sameToken := srv.MasterToken != 0 && srv.MasterToken == srv2.MasterToken
 	return sameClientID && (sameAddr || sameToken)
@@ -352,9 +421,24 @@ func ReadServersList(r io.Reader, full bool, res *[]EIServerInfo) error {
 	return err
 }
 
+// WriteServersList writes the servers in the game format. Servers without
+// IPv4 address are skipped.
 func WriteServersList(w io.Writer, full bool, servers []EIServerInfo) error {
-	for _, server := range servers {
-		if err := WriteServerInfo(w, full, &server); err != nil {
+	return WriteServersListFunc(w, full, servers, nil)
+}
+
+// WriteServersListFunc is like WriteServersList, but calls skipped for each
+// skipped server if it's not nil.
+func WriteServersListFunc(w io.Writer, full bool, servers []EIServerInfo,
+	skipped func(srv *EIServerInfo, err error)) error {
+	for i := range servers {
+		err := WriteServerInfo(w, full, &servers[i])
+		if errors.Is(err, ErrNoIPv4) {
+			if skipped != nil {
+				skipped(&servers[i], err)
+			}
+			continue
+		} else if err != nil {
 			return err
 		}
 	}
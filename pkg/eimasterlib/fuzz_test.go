@@ -0,0 +1,37 @@
+//go:build go1.18
+// +build go1.18
+
+package eimasterlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/ei-projects/eimaster/pkg/lzevil"
+)
+
+// FuzzReadServersList checks compressed lists from hostile masters are
+// reported by errors. The corpus is in testdata/fuzz/FuzzReadServersList.
+func FuzzReadServersList(f *testing.F) {
+	var list bytes.Buffer
+	WriteServersList(&list, true, []EIServerInfo{
+		{Addr: net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 28004},
+			EIGameInfo: EIGameInfo{ClientID: 1, Name: "Alpha", Quest: "Quest", PlayerNames: []string{"Игрок"}}},
+		{Addr: net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 28005},
+			EIGameInfo: EIGameInfo{ClientID: 2, Name: "Beta", PlayerNames: []string{}}},
+	})
+	f.Add(lzevil.Compress(list.Bytes()), true)
+	f.Add(lzevil.Compress(list.Bytes()), false)
+	f.Fuzz(func(t *testing.T, data []byte, full bool) {
+		var servers []EIServerInfo
+		r := lzevil.NewReaderLimit(bytes.NewReader(data), maxListDataSize)
+		if err := ReadServersList(r, full, &servers); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteServersList(&buf, full, servers); err != nil {
+			t.Errorf("Read servers aren't written back: %s", err)
+		}
+	})
+}
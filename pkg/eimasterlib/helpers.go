@@ -1,8 +1,10 @@
 package eimasterlib
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 
@@ -80,14 +82,60 @@ func writeIntAsInt32(w io.Writer, val int) error {
 	return writeLE(w, int32(val))
 }
 
+// DecodeWin1251 decodes Windows-1251 string. Control characters are kept, the
+// master server removes them by its content policy.
 func DecodeWin1251(encoded []byte) string {
 	dec := charmap.Windows1251.NewDecoder()
 	out, _ := dec.Bytes(encoded)
 	return string(out)
 }
 
+// EncodeWin1251 encodes the string to Windows-1251. Characters which are not
+// supported by the encoding are replaced with '?'.
 func EncodeWin1251(decoded string) []byte {
-	enc := charmap.Windows1251.NewEncoder()
-	out, _ := enc.String(decoded)
-	return []byte(out)
+	out := make([]byte, 0, len(decoded))
+	for _, r := range decoded {
+		if b, ok := charmap.Windows1251.EncodeRune(r); ok {
+			out = append(out, b)
+		} else {
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+func encodeASCII(src []uint8) string {
+	var buf bytes.Buffer
+	for _, b := range src {
+		if b < 32 || b > 126 {
+			buf.WriteRune('.')
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// HexDump formats data like `hexdump -C` does. It's used to log packets.
+func HexDump(data []byte) string {
+	result := ""
+	offset := 0
+	for offset < len(data) {
+		chunkLen := len(data) - offset
+		if chunkLen > 16 {
+			chunkLen = 16
+		}
+		chunk := ""
+		for i := 0; i < chunkLen; i++ {
+			if i > 0 && i%8 == 0 {
+				chunk += " "
+			}
+			chunk += fmt.Sprintf("%02X ", data[offset+i])
+		}
+		result += fmt.Sprintf("%08X  %-49s |%s|\n", offset,
+			chunk, encodeASCII(data[offset:offset+chunkLen]))
+		offset += chunkLen
+	}
+	result += fmt.Sprintf("%08X\n", offset)
+	return result
 }
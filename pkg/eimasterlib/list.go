@@ -0,0 +1,48 @@
+package eimasterlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ei-projects/eimaster/pkg/lzevil"
+)
+
+// maxListSize limits the size of compressed servers list sent by master server.
+const maxListSize = 100000
+
+// maxListDataSize limits the size of uncompressed servers list.
+const maxListDataSize = 16 << 20
+
+// GetServersList requests the list of servers from the master server at addr
+// the same way the game does. The whole exchange must fit into timeout.
+func GetServersList(addr string, clientID uint32, timeout time.Duration) ([]EIServerInfo, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("net.Dial failed: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := binary.Write(conn, binary.LittleEndian, clientID); err != nil {
+		return nil, fmt.Errorf("conn.Write failed: %w", err)
+	}
+
+	// The size includes itself
+	var size int32
+	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+		return nil, fmt.Errorf("conn.Read failed: %w", err)
+	}
+	if size < 4 || size > maxListSize {
+		return nil, fmt.Errorf("invalid size of servers list: %d", size)
+	}
+
+	var servers []EIServerInfo
+	lzreader := lzevil.NewReaderLimit(io.LimitReader(conn, int64(size-4)), maxListDataSize)
+	if err := ReadServersList(lzreader, false, &servers); err != nil {
+		return nil, fmt.Errorf("failed to read servers: %w", err)
+	}
+	return servers, nil
+}
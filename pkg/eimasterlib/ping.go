@@ -0,0 +1,113 @@
+package eimasterlib
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// PingProbe is the packet the game server answers to.
+var PingProbe = []byte{3, 0, 0, 0}
+
+// PingStats are statistics of probes sent to the game server. RTT and Loss are
+// exponentially weighted moving averages, Jitter is the mean deviation of RTT
+// as in RFC 3550. Times are in milliseconds, Loss is the share of unanswered
+// probes from 0 to 1.
+type PingStats struct {
+	RTT      float64 `json:"rtt"`
+	Jitter   float64 `json:"jitter"`
+	Loss     float64 `json:"loss"`
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+}
+
+// pingWeight is the weight of the new sample in moving averages.
+const pingWeight = 0.125
+
+// AddReply accounts the answered probe.
+func (st *PingStats) AddReply(rtt time.Duration) {
+	ms := float64(rtt) / float64(time.Millisecond)
+	if st.Received == 0 {
+		st.RTT = ms
+	} else {
+		st.Jitter += (math.Abs(ms-st.RTT) - st.Jitter) / 16
+		st.RTT += (ms - st.RTT) * pingWeight
+	}
+	st.addProbe(0)
+	st.Received++
+}
+
+// AddLoss accounts the unanswered probe.
+func (st *PingStats) AddLoss() {
+	st.addProbe(1)
+}
+
+func (st *PingStats) addProbe(lost float64) {
+	if st.Sent == 0 {
+		st.Loss = lost
+	} else {
+		st.Loss += (lost - st.Loss) * pingWeight
+	}
+	st.Sent++
+}
+
+// Ping returns RTT rounded to milliseconds, 0 if no probe is answered.
+func (st *PingStats) Ping() int {
+	if st.Received == 0 {
+		return 0
+	}
+	if ping := int(math.Round(st.RTT)); ping > 0 {
+		return ping
+	}
+	return 1
+}
+
+// PingServer sends probe packets to the game server and stores the time of the
+// first reply in srv.Ping. Ping is 0 if the server hasn't answered in time.
+func PingServer(srv *EIServerInfo, timeout time.Duration) error {
+	conn, err := net.DialUDP("udp", nil, &srv.Addr)
+	if err != nil {
+		return fmt.Errorf("net.DialUDP failed: %w", err)
+	}
+	defer conn.Close()
+
+	startTime := time.Now()
+	conn.SetDeadline(startTime.Add(timeout))
+
+	for i := 0; i < 5; i++ {
+		n, err := conn.Write(PingProbe)
+		if n < len(PingProbe) || err != nil {
+			return fmt.Errorf("conn.Write failed: %w. %d bytes were written", err, n)
+		}
+	}
+
+	ping := 0
+	buf := make([]byte, 256)
+	n, _ := conn.Read(buf)
+	if n > 0 {
+		ping = int(time.Since(startTime).Milliseconds())
+		if ping == 0 {
+			ping = 1
+		} else if ping < 0 {
+			ping = 0
+		}
+	}
+	srv.Ping = ping
+	return nil
+}
+
+// PingServers pings all servers concurrently. Errors are ignored, servers which
+// couldn't be pinged just have zero ping.
+func PingServers(servers []EIServerInfo, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			PingServer(&servers[i], timeout)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,132 @@
+package eimasterlib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Game servers answer PingProbe with replies whose layout depends on the game
+// version. Decoders of known layouts are registered by RegisterReplyDecoder,
+// DecodePingReply tries them in the order of registration.
+
+// ErrUnknownReply is returned by decoders if the reply isn't of their layout.
+var ErrUnknownReply = errors.New("unknown ping reply layout")
+
+// PingReply is a decoded reply to PingProbe.
+type PingReply struct {
+	Layout string            `json:"layout"` // Name of the decoder
+	Fields map[string]string `json:"fields"` // Decoded values for display
+	// Game has the game info found in the reply, nil if the layout has none.
+	Game *EIGameInfo `json:"-"`
+}
+
+// ReplyDecoder decodes ping replies of some layout. It returns ErrUnknownReply
+// if data is not of the layout.
+type ReplyDecoder interface {
+	Name() string
+	Decode(data []byte) (*PingReply, error)
+}
+
+var (
+	replyDecodersMu sync.RWMutex
+	replyDecoders   []ReplyDecoder
+)
+
+func init() {
+	RegisterReplyDecoder(gameInfoReplyDecoder{})
+}
+
+// RegisterReplyDecoder adds the decoder, a decoder with the same name is
+// replaced.
+func RegisterReplyDecoder(decoder ReplyDecoder) {
+	replyDecodersMu.Lock()
+	defer replyDecodersMu.Unlock()
+	for i, d := range replyDecoders {
+		if d.Name() == decoder.Name() {
+			replyDecoders[i] = decoder
+			return
+		}
+	}
+	replyDecoders = append(replyDecoders, decoder)
+}
+
+// DecodePingReply decodes the reply by the first decoder knowing its layout.
+// ErrUnknownReply is returned if there is no such decoder.
+func DecodePingReply(data []byte) (*PingReply, error) {
+	replyDecodersMu.RLock()
+	defer replyDecodersMu.RUnlock()
+	for _, decoder := range replyDecoders {
+		reply, err := decoder.Decode(data)
+		if errors.Is(err, ErrUnknownReply) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", decoder.Name(), err)
+		}
+		reply.Layout = decoder.Name()
+		return reply, nil
+	}
+	return nil, ErrUnknownReply
+}
+
+// Mismatches returns names of the fields of the game info in the reply which
+// differ from the registered game. Nil is returned if the reply has no game.
+func (reply *PingReply) Mismatches(game *EIGameInfo) []string {
+	if reply.Game == nil {
+		return nil
+	}
+	var names []string
+	fields := []struct {
+		name          string
+		reply, stored interface{}
+	}{
+		{"name", reply.Game.Name, game.Name},
+		{"quest", reply.Game.Quest, game.Quest},
+		{"players_count", reply.Game.PlayersCount, game.PlayersCount},
+		{"max_players_count", reply.Game.MaxPlayersCount, game.MaxPlayersCount},
+		{"has_password", reply.Game.HasPassword, game.HasPassword},
+		{"allod_index", reply.Game.AllodIndex, game.AllodIndex},
+	}
+	for _, f := range fields {
+		if f.reply != f.stored {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// gameInfoReplyDecoder decodes replies of modified game servers which answer
+// with PingProbe followed by the game info in the announcement format.
+type gameInfoReplyDecoder struct{}
+
+func (gameInfoReplyDecoder) Name() string {
+	return "gameinfo"
+}
+
+func (gameInfoReplyDecoder) Decode(data []byte) (*PingReply, error) {
+	if !bytes.HasPrefix(data, PingProbe) || len(data) == len(PingProbe) {
+		return nil, ErrUnknownReply
+	}
+	r := bytes.NewReader(data[len(PingProbe):])
+	var game EIGameInfo
+	if err := ReadGameInfo(r, false, &game); err != nil {
+		return nil, ErrUnknownReply
+	}
+	if r.Len() > 0 {
+		r.Reset(data[len(PingProbe):])
+		if err := ReadGameInfo(r, true, &game); err != nil {
+			return nil, err
+		}
+	}
+	fields := map[string]string{
+		"name":              game.Name,
+		"quest":             game.Quest,
+		"players_count":     strconv.Itoa(int(game.PlayersCount)),
+		"max_players_count": strconv.Itoa(int(game.MaxPlayersCount)),
+		"has_password":      strconv.FormatBool(game.HasPassword),
+		"allod_index":       strconv.Itoa(int(game.AllodIndex)),
+	}
+	return &PingReply{Fields: fields, Game: &game}, nil
+}
@@ -0,0 +1,132 @@
+package lzevil_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+	"github.com/ei-projects/eimaster/pkg/lzevil"
+)
+
+// serversList returns the list of count servers in the format sent to games,
+// with names, quests and nicks alike the ones of real servers. Master servers
+// send lists without nicks, i.e. not full.
+func serversList(count int, full bool) []byte {
+	names := []string{"Аллоды 2 Кооператив", "Evil Islands RU", "Проклятые земли", "Co-op night"}
+	quests := []string{"Гипат", "Суслангер", "Ингос", "Джигран", ""}
+	nicks := []string{"Зак", "Ratmir", "Ирина", "Shaman", "Маг_огня", "Warrior777"}
+	servers := make([]master.EIServerInfo, count)
+	for i := range servers {
+		srv := &servers[i]
+		srv.Addr = net.UDPAddr{IP: net.IPv4(85, 26, byte(i/7), byte(i*37)), Port: 8885 + i%3}
+		srv.ClientID = uint32(i) * 2654435761
+		srv.Name = fmt.Sprintf("%s #%d", names[i%len(names)], i%13)
+		srv.Quest = quests[i%len(quests)]
+		srv.MaxPlayersCount = 8
+		srv.PlayersCount = uint8(i % 9)
+		srv.AllodIndex = uint8(i % 5)
+		srv.PlayerNames = []string{}
+		for j := 0; j < int(srv.PlayersCount); j++ {
+			srv.PlayerNames = append(srv.PlayerNames, nicks[(i+j)%len(nicks)])
+		}
+	}
+	var buf bytes.Buffer
+	master.WriteServersList(&buf, full, servers)
+	return buf.Bytes()
+}
+
+// benchPayload is a list compressed by benchmarks.
+type benchPayload struct {
+	name   string
+	data   []byte
+	packed []byte // As the master has sent it
+}
+
+// benchPayloads returns generated lists of the given sizes as master servers
+// send them, for the largest size the full list with nicks, and the lists
+// captured from master servers. Captured lists in testdata/lists are TCP
+// responses of masters to games, with the size header.
+func benchPayloads(b *testing.B, counts ...int) []benchPayload {
+	var payloads []benchPayload
+	for _, count := range counts {
+		data := serversList(count, false)
+		payloads = append(payloads, benchPayload{fmt.Sprintf("servers=%d", count), data, lzevil.Compress(data)})
+	}
+	last := counts[len(counts)-1]
+	data := serversList(last, true)
+	payloads = append(payloads, benchPayload{fmt.Sprintf("servers=%d/full", last), data, lzevil.Compress(data)})
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "lists", "*.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, path := range paths {
+		resp, err := ioutil.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := lzevil.Decompress(resp[4:])
+		if err != nil {
+			b.Fatalf("Failed to unpack %s: %s", path, err)
+		}
+		payloads = append(payloads, benchPayload{"captured=" + filepath.Base(path), data, resp[4:]})
+	}
+	return payloads
+}
+
+func BenchmarkWriterLevel(b *testing.B) {
+	for _, payload := range benchPayloads(b, 30, 300, 3000) {
+		data := payload.data
+		for level := lzevil.BestSpeed; level <= lzevil.BestCompression; level++ {
+			b.Run(fmt.Sprintf("%s/level=%d", payload.name, level), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				var packed bytes.Buffer
+				for i := 0; i < b.N; i++ {
+					packed.Reset()
+					w, _ := lzevil.NewWriterLevel(&packed, len(data), level)
+					w.Write(data)
+				}
+				b.ReportMetric(float64(len(data))/float64(packed.Len()), "ratio")
+				if unpacked, err := lzevil.Decompress(packed.Bytes()); err != nil || !bytes.Equal(unpacked, data) {
+					b.Fatalf("Packed list isn't unpacked: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkReader decodes lists by reads of the given size. The target is at
+// least 1.5 times the throughput of the former bit-by-bit decoder on every
+// payload and read size, measured by this benchmark on the same machine. The
+// table decoder is about 2.5 times faster on a current x86 server.
+func BenchmarkReader(b *testing.B) {
+	for _, payload := range benchPayloads(b, 30, 3000) {
+		data, packed := payload.data, payload.packed
+		for _, size := range []int{64, 4096, len(data)} {
+			b.Run(fmt.Sprintf("%s/read=%d", payload.name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				buf := make([]byte, size)
+				for i := 0; i < b.N; i++ {
+					r, n := lzevil.NewReader(bytes.NewReader(packed)), 0
+					for {
+						m, err := r.Read(buf)
+						n += m
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							b.Fatal(err)
+						}
+					}
+					if n != len(data) {
+						b.Fatalf("Unexpected size of unpacked list: %d", n)
+					}
+				}
+			})
+		}
+	}
+}
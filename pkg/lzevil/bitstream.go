@@ -1,83 +1,131 @@
 package lzevil
 
-import "io"
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Bits are written to bytes reserved when the first bit of the byte is
+// written, raw bytes are written right after the last reserved one. So a raw
+// byte is the byte following the one the last read bit came from.
+//
+// bitsReader fetches whole bytes of bits ahead, up to 64 bits at once. The
+// fetched bits are the rest of the byte being read and fetched bytes after it,
+// so bitsLen%8 bits are the rest of the byte and the next raw byte is the
+// first fetched byte after them, if any.
+
+const readBufferSize = 4096
 
 type bitsReader struct {
-	reader   io.Reader
-	err      error
-	bits     uint32
-	bitsLen  uint8
-	data     []byte
-	dataPos  int
-	dataSize int
+	reader  io.Reader
+	err     error
+	readErr error  // Error of the reader, reported when data is needed
+	bits    uint64 // Fetched bits, the next bit is the lowest
+	bitsLen uint8
+	data    []byte
+	dataPos int
 }
 
 func newBitsReader(r io.Reader) *bitsReader {
 	return &bitsReader{
 		reader: r,
-		data:   make([]byte, 256),
+		data:   make([]byte, 0, readBufferSize),
 	}
 }
 
-func (br *bitsReader) fetchBits() {
-	br.bits |= uint32(br.data[br.dataPos]) << br.bitsLen
-	br.bitsLen += 8
-	br.dataPos++
-	br.dataSize--
+// fillBuffer reads the next data from the reader, it returns false if there is
+// none.
+func (br *bitsReader) fillBuffer() bool {
+	for br.readErr == nil {
+		n, err := br.reader.Read(br.data[:cap(br.data)])
+		br.data = br.data[:n]
+		br.dataPos = 0
+		br.readErr = err
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fill fetches bytes until there are at least bitsLen bits or data ends,
+// bitsLen must not exceed 56.
+func (br *bitsReader) fill(bitsLen uint8) {
+	for br.bitsLen < bitsLen {
+		if br.dataPos+8 <= len(br.data) {
+			n := (63 - br.bitsLen) / 8
+			v := binary.LittleEndian.Uint64(br.data[br.dataPos:])
+			br.bits |= (v & (1<<(n*8) - 1)) << br.bitsLen
+			br.bitsLen += n * 8
+			br.dataPos += int(n)
+		} else if br.dataPos < len(br.data) || br.fillBuffer() {
+			br.bits |= uint64(br.data[br.dataPos]) << br.bitsLen
+			br.bitsLen += 8
+			br.dataPos++
+		} else {
+			return
+		}
+	}
+}
+
+// need fetches at least bitsLen bits. If data ends before, err is set to
+// io.EOF if no bytes are fetched or io.ErrUnexpectedEOF otherwise, and false is
+// returned.
+func (br *bitsReader) need(bitsLen uint8) bool {
+	if br.bitsLen >= bitsLen {
+		return true
+	}
+	fetched := br.bitsLen
+	br.fill(bitsLen)
+	if br.bitsLen >= bitsLen {
+		return true
+	}
+	if br.err == nil {
+		switch {
+		case br.readErr != nil && !errors.Is(br.readErr, io.EOF):
+			br.err = br.readErr
+		case br.bitsLen == fetched:
+			br.err = io.EOF
+		default:
+			br.err = io.ErrUnexpectedEOF
+		}
+	}
+	return false
 }
 
 func (br *bitsReader) getBits(bitsLen uint8) uint32 {
-	res := br.bits & (1<<bitsLen - 1)
+	res := uint32(br.bits & (1<<bitsLen - 1))
 	br.bits >>= bitsLen
 	br.bitsLen -= bitsLen
 	return res
 }
 
-func (br *bitsReader) fillBuffer(requiredBytes int) bool {
-	if br.err != nil {
-		return false
-	}
-	copy(br.data, br.data[br.dataPos:])
-	n, err := io.ReadAtLeast(br.reader, br.data[br.dataSize:cap(br.data)], requiredBytes)
-	br.dataSize += n
-	br.dataPos = 0
-	br.data = br.data[0:br.dataSize]
-	br.err = err
-	return n >= requiredBytes
-}
-
-func (br *bitsReader) readBit() uint32 {
-	if br.bitsLen > 0 {
-		return br.getBits(1)
-	}
-	if br.dataSize > 0 || br.fillBuffer(1) {
-		br.fetchBits()
-		return br.getBits(1)
-	}
-	return 0
-}
-
 func (br *bitsReader) readBits(bitsLen uint8) uint32 {
 	if bitsLen < 1 || bitsLen > 24 {
 		panic("Invalid bitsLen")
 	}
-	requiredBytes := int(bitsLen-br.bitsLen+7)/8 - br.dataSize
-	if requiredBytes <= 0 || br.fillBuffer(requiredBytes) {
-		for br.bitsLen < bitsLen {
-			br.fetchBits()
-		}
-		return br.getBits(bitsLen)
+	if !br.need(bitsLen) {
+		return 0
 	}
-	return 0
+	return br.getBits(bitsLen)
 }
 
 func (br *bitsReader) readByte() byte {
-	if br.dataSize > 0 || br.fillBuffer(1) {
+	if br.bitsLen >= 8 {
+		// The byte is fetched already, it follows the rest of the byte being read.
+		restLen := br.bitsLen & 7
+		res := byte(br.bits >> restLen)
+		br.bits = br.bits&(1<<restLen-1) | br.bits>>(restLen+8)<<restLen
+		br.bitsLen -= 8
+		return res
+	}
+	if br.dataPos < len(br.data) || br.fillBuffer() {
 		res := br.data[br.dataPos]
 		br.dataPos++
-		br.dataSize--
 		return res
 	}
+	br.need(br.bitsLen + 8)
 	return 0
 }
 
@@ -0,0 +1,26 @@
+//go:build go1.18
+// +build go1.18
+
+package lzevil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzReader checks malformed data is reported by errors. The corpus is in
+// testdata/fuzz/FuzzReader, run `go test -fuzz FuzzReader` to extend it.
+func FuzzReader(f *testing.F) {
+	f.Add(testPackedData)
+	f.Add(Compress([]byte("1123xxxxx3211")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		unpacked, err := ioutil.ReadAll(NewReaderLimit(bytes.NewReader(data), 1<<20))
+		if err != nil {
+			return
+		}
+		if repacked, err := Decompress(Compress(unpacked)); err != nil || !bytes.Equal(repacked, unpacked) {
+			t.Errorf("Unpacked data isn't packed back: %v", err)
+		}
+	})
+}
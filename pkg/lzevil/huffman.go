@@ -5,6 +5,10 @@ import (
 	"sort"
 )
 
+// maxDecodeBits limits bits of a code with its extra bits, so that they are
+// fetched at once.
+const maxDecodeBits = 32
+
 type symbol struct {
 	base         uint32
 	bits         uint16
@@ -20,13 +24,21 @@ func (sym *symbol) contains(val uint32) bool {
 	return sym.base <= val && val <= sym.max()
 }
 
+// tableEntry is the symbol whose code is the low bits of the entry index in
+// the decoding table, bitsLen is 0 if there is no such code.
+type tableEntry struct {
+	base         uint32
+	bitsLen      uint8
+	extraBitsLen uint8
+}
+
 type huffmanCoder struct {
 	symbols     []symbol
 	minBitsLen  uint8
 	maxBitsLen  uint8
 	minValue    uint32
 	maxValue    uint32
-	decodeTable []uint16
+	decodeTable []tableEntry // Indexed by the next maxBitsLen bits
 }
 
 func newHuffmanCoder(symbols []symbol) *huffmanCoder {
@@ -66,15 +78,15 @@ func newHuffmanCoder(symbols []symbol) *huffmanCoder {
 	coder.maxBitsLen = maxBitsLen
 	coder.minValue = symbols[0].base
 	coder.maxValue = symbols[len(symbols)-1].max()
-	coder.decodeTable = make([]uint16, 1<<(maxBitsLen+1)-2)
+	coder.decodeTable = make([]tableEntry, 1<<maxBitsLen)
 	for _, sym := range coder.symbols {
-		index := int((1 << sym.bitsLen) + sym.bits - 2)
-		if sym.extraBitsLen >= 1<<4 || sym.base+1 >= 1<<12 || coder.decodeTable[index] != 0 {
-			panic("Invalid symbols")
+		if sym.bitsLen+sym.extraBitsLen > maxDecodeBits {
+			panic("Invalid symbols: code is too long")
+		}
+		entry := tableEntry{base: sym.base, bitsLen: sym.bitsLen, extraBitsLen: sym.extraBitsLen}
+		for index := int(sym.bits); index < len(coder.decodeTable); index += 1 << sym.bitsLen {
+			coder.decodeTable[index] = entry
 		}
-
-		packedSym := (uint32(sym.extraBitsLen) << 12) | sym.base
-		coder.decodeTable[index] = uint16(packedSym + 1)
 	}
 
 	return coder
@@ -99,22 +111,26 @@ func (coder *huffmanCoder) encodeValue(val uint32, bw *bitsWriter) {
 	}
 }
 
-func (coder *huffmanCoder) decodeValue(br *bitsReader) uint32 {
-	var bits uint32
-	for bitsLen := uint8(1); bitsLen <= coder.maxBitsLen; bitsLen++ {
-		bits |= br.readBit() << (bitsLen - 1)
-		index := int((1 << bitsLen) + bits - 2)
-		packedSym := coder.decodeTable[index]
-		if packedSym == 0 {
-			continue
-		}
-		packedSym--
-
-		base, extraBitsLen := uint32(packedSym&(1<<12-1)), uint8(packedSym>>12)
-		if extraBitsLen > 0 {
-			return base + br.readBits(extraBitsLen)
+// decodeValue reads the next value. ErrInvalidData is returned if the bits
+// don't form a code of the coder. The code and its extra bits are found by one
+// lookup of the next maxBitsLen bits in the decoding table.
+func (coder *huffmanCoder) decodeValue(br *bitsReader) (uint32, error) {
+	if br.bitsLen < maxDecodeBits {
+		br.fill(maxDecodeBits)
+	}
+	entry := coder.decodeTable[br.bits&uint64(len(coder.decodeTable)-1)]
+	if entry.bitsLen == 0 {
+		if !br.need(coder.maxBitsLen) {
+			return 0, br.err
 		}
-		return base
+		return 0, ErrInvalidData
+	}
+	bitsLen := entry.bitsLen + entry.extraBitsLen
+	if bitsLen > br.bitsLen && !br.need(bitsLen) {
+		return 0, br.err
 	}
-	panic("Invalid code")
+	val := entry.base + uint32(br.bits>>entry.bitsLen)&(1<<entry.extraBitsLen-1)
+	br.bits >>= bitsLen
+	br.bitsLen -= bitsLen
+	return val, nil
 }
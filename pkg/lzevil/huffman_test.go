@@ -21,8 +21,8 @@ func TestCoder(t *testing.T) {
 				coder.encodeValue(val, bw)
 				bw.flush()
 				br := newBitsReader(&buf)
-				val2 := coder.decodeValue(br)
-				if val != val2 || br.err != nil {
+				val2, err := coder.decodeValue(br)
+				if val != val2 || err != nil || br.err != nil {
 					t.FailNow()
 				}
 			}
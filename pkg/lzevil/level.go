@@ -0,0 +1,290 @@
+package lzevil
+
+import (
+	"errors"
+	"io"
+)
+
+// Compression levels of NewWriterLevel. All levels produce data readable by
+// the game, they differ in how blocks are chosen.
+const (
+	// BestSpeed takes the first match found, it's the level of NewWriter.
+	BestSpeed = 1
+	// LazyCompression takes a match only if the next byte doesn't start a
+	// longer one.
+	LazyCompression = 2
+	// BestCompression chooses blocks taking the least bits for the whole
+	// chunk of data under the fixed codes of the format.
+	BestCompression = 3
+
+	DefaultCompression = BestSpeed
+)
+
+var (
+	// ErrInvalidLevel is returned by NewWriterLevel for unknown levels.
+	ErrInvalidLevel = errors.New("Invalid compression level")
+	// ErrInvalidSize is returned by NewWriterLevel for negative sizes and
+	// sizes that don't fit the header.
+	ErrInvalidSize = errors.New("Invalid size")
+)
+
+const (
+	minBlockSize = 2
+	literalBits  = 9       // Bit 0 of block size 1 followed by the byte
+	chunkSize    = 1 << 15 // Data parsed at once by lazy and optimal levels
+)
+
+// NewWriterLevel is like NewWriter with the given compression level from
+// BestSpeed to BestCompression.
+func NewWriterLevel(w io.Writer, size, level int) (io.WriteCloser, error) {
+	if level < BestSpeed || level > BestCompression {
+		return nil, ErrInvalidLevel
+	}
+	if size < 0 || size > maxDataSize {
+		return nil, ErrInvalidSize
+	}
+	lzw := newLZWriter(w, int32(size))
+	if level > BestSpeed {
+		lzw.parser = newParser(level)
+	}
+	return lzw, nil
+}
+
+// codeBits returns the number of bits taken by the value.
+func (coder *huffmanCoder) codeBits(val uint32) int {
+	for _, sym := range coder.symbols {
+		if sym.contains(val) {
+			return int(sym.bitsLen) + int(sym.extraBitsLen)
+		}
+	}
+	panic("Invalid value")
+}
+
+var blockSizeBits, distBits = func() (sizes, dists []int) {
+	sizes = make([]int, blockSizeCoder.maxValue+1)
+	for size := minBlockSize; size < len(sizes); size++ {
+		sizes[size] = blockSizeCoder.codeBits(uint32(size))
+	}
+	dists = make([]int, windowSize)
+	for dist := range dists {
+		dists[dist] = distCoder.codeBits(uint32(dist))
+	}
+	return sizes, dists
+}()
+
+// blockBits returns the number of bits taken by the block.
+func blockBits(size, offset int) int {
+	return blockSizeBits[size] + distBits[offset-1]
+}
+
+// parser chooses blocks of buffered data for levels above BestSpeed. Data is
+// parsed by chunks, the last windowSize bytes of the previous chunk are kept
+// as history which blocks may refer to.
+type parser struct {
+	optimal  bool
+	maxChain int // How many previous positions are compared at most
+
+	data    []byte
+	history int            // Length of the history at the start of data
+	head    [1 << 16]int32 // Last position of two bytes, -1 if none
+	prev    []int32        // Previous position of the same two bytes
+	price   []int          // Bits to encode data up to the position
+	choice  []parsedBlock  // Optimal block ending at the position
+	blocks  []parsedBlock
+}
+
+// parsedBlock is either a literal byte (size 1) or a block of size bytes at
+// offset bytes back.
+type parsedBlock struct {
+	size, offset int
+}
+
+func newParser(level int) *parser {
+	if level == BestCompression {
+		return &parser{optimal: true, maxChain: 256}
+	}
+	return &parser{maxChain: 128}
+}
+
+// write buffers data and encodes the chunks which are full.
+func (pr *parser) write(data []byte, lzw *lzWriter) {
+	for len(data) > 0 && lzw.err == nil {
+		n := chunkSize + pr.history - len(pr.data)
+		if n > len(data) {
+			n = len(data)
+		}
+		pr.data = append(pr.data, data[:n]...)
+		data = data[n:]
+		if len(pr.data)-pr.history == chunkSize {
+			pr.encode(lzw)
+		}
+	}
+}
+
+// encode writes the blocks of buffered data and keeps its tail as history.
+func (pr *parser) encode(lzw *lzWriter) {
+	pr.blocks = pr.blocks[:0]
+	if pr.optimal {
+		pr.parseOptimal()
+	} else {
+		pr.parseLazy()
+	}
+	pos := pr.history
+	for _, block := range pr.blocks {
+		if block.size == 1 {
+			lzw.bw.writeBit(0)
+			lzw.bw.writeByte(pr.data[pos])
+		} else {
+			blockSizeCoder.encodeValue(uint32(block.size), lzw.bw)
+			distCoder.encodeValue(uint32(block.offset-1), lzw.bw)
+		}
+		pos += block.size
+		if lzw.err = lzw.bw.flushBuffer(false); lzw.err != nil {
+			return
+		}
+	}
+
+	history := len(pr.data)
+	if history > windowSize {
+		history = windowSize
+	}
+	pr.data = append(pr.data[:0], pr.data[len(pr.data)-history:]...)
+	pr.history = history
+}
+
+// resetChains prepares hash chains of the data and adds the history to them.
+func (pr *parser) resetChains() {
+	for i := range pr.head {
+		pr.head[i] = -1
+	}
+	if cap(pr.prev) < len(pr.data) {
+		pr.prev = make([]int32, len(pr.data))
+	}
+	pr.prev = pr.prev[:len(pr.data)]
+	for pos := 0; pos < pr.history; pos++ {
+		pr.insert(pos)
+	}
+}
+
+func (pr *parser) insert(pos int) {
+	if pos+1 < len(pr.data) {
+		key := int(pr.data[pos])<<8 | int(pr.data[pos+1])
+		pr.prev[pos] = pr.head[key]
+		pr.head[key] = int32(pos)
+	}
+}
+
+// matches calls found for previous positions matching at pos from the nearest
+// one, as long as each match is longer than the previous. It stops when found
+// returns false or the longest block is found.
+func (pr *parser) matches(pos int, found func(size, offset int) bool) {
+	if pos+minBlockSize > len(pr.data) {
+		return
+	}
+	maxSize := len(pr.data) - pos
+	if maxSize > int(blockSizeCoder.maxValue) {
+		maxSize = int(blockSizeCoder.maxValue)
+	}
+	bestSize := minBlockSize - 1
+	key := int(pr.data[pos])<<8 | int(pr.data[pos+1])
+	cand := int(pr.head[key])
+	for chain := 0; cand >= 0 && pos-cand <= windowSize && chain < pr.maxChain; chain++ {
+		// The first two bytes are equal by the key.
+		size := minBlockSize
+		for size < maxSize && pr.data[cand+size] == pr.data[pos+size] {
+			size++
+		}
+		if size > bestSize {
+			bestSize = size
+			if !found(size, pos-cand) || size == maxSize {
+				return
+			}
+		}
+		cand = int(pr.prev[cand])
+	}
+}
+
+// longest returns the longest and nearest block at pos, size is 0 if none.
+func (pr *parser) longest(pos int) (size, offset int) {
+	pr.matches(pos, func(s, o int) bool {
+		size, offset = s, o
+		return true
+	})
+	return size, offset
+}
+
+func (pr *parser) parseLazy() {
+	pr.resetChains()
+	pos := pr.history
+	size, offset := pr.longest(pos)
+	for pos < len(pr.data) {
+		pr.insert(pos)
+		if size == 0 {
+			pr.blocks = append(pr.blocks, parsedBlock{size: 1})
+			pos++
+			size, offset = pr.longest(pos)
+			continue
+		}
+		nextSize, nextOffset := pr.longest(pos + 1)
+		if nextSize > size && (literalBits+blockBits(nextSize, nextOffset))*size <
+			blockBits(size, offset)*(nextSize+1) {
+			// The byte and the next block take less bits per byte.
+			pr.blocks = append(pr.blocks, parsedBlock{size: 1})
+			pos++
+			size, offset = nextSize, nextOffset
+			continue
+		}
+		pr.blocks = append(pr.blocks, parsedBlock{size: size, offset: offset})
+		for end := pos + size; pos+1 < end; {
+			pos++
+			pr.insert(pos)
+		}
+		pos++
+		size, offset = pr.longest(pos)
+	}
+}
+
+// parseOptimal finds the cheapest blocks by dynamic programming. Bits of
+// distances don't decrease with distance, so for every size the nearest block
+// is the cheapest one.
+func (pr *parser) parseOptimal() {
+	pr.resetChains()
+	n := len(pr.data)
+	if cap(pr.price) < n+1 {
+		pr.price = make([]int, n+1)
+		pr.choice = make([]parsedBlock, n+1)
+	}
+	pr.price, pr.choice = pr.price[:n+1], pr.choice[:n+1]
+	for pos := pr.history + 1; pos <= n; pos++ {
+		pr.price[pos] = -1
+	}
+	pr.price[pr.history] = 0
+
+	relax := func(pos int, block parsedBlock, bits int) {
+		end := pos + block.size
+		if price := pr.price[pos] + bits; pr.price[end] < 0 || price < pr.price[end] {
+			pr.price[end] = price
+			pr.choice[end] = block
+		}
+	}
+	for pos := pr.history; pos < n; pos++ {
+		relax(pos, parsedBlock{size: 1}, literalBits)
+		lastSize := minBlockSize - 1
+		pr.matches(pos, func(size, offset int) bool {
+			for s := lastSize + 1; s <= size; s++ {
+				relax(pos, parsedBlock{size: s, offset: offset}, blockBits(s, offset))
+			}
+			lastSize = size
+			return true
+		})
+		pr.insert(pos)
+	}
+
+	// The blocks are found backwards from the end.
+	for pos := n; pos > pr.history; pos -= pr.choice[pos].size {
+		pr.blocks = append(pr.blocks, pr.choice[pos])
+	}
+	for i, j := 0, len(pr.blocks)-1; i < j; i, j = i+1, j-1 {
+		pr.blocks[i], pr.blocks[j] = pr.blocks[j], pr.blocks[i]
+	}
+}
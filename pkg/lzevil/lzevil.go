@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 )
@@ -49,7 +50,9 @@ type lzWriter struct {
 	err          error
 	writer       *bufio.Writer
 	bw           *bitsWriter
-	originalSize int32 // Size of uncompressed data
+	streaming    bool    // The size is unknown, it's written by streamWriter
+	parser       *parser // Nil for BestSpeed
+	originalSize int32   // Size of uncompressed data, maxDataSize if streaming
 	writedSize   int32
 	window       []byte
 	windowPos    int
@@ -60,14 +63,24 @@ type lzWriter struct {
 	hashPrev     [windowSize]int
 }
 
-func NewWriter(w io.Writer, size int) io.Writer {
+// ErrSizeMismatch is returned by writers if the size of written data differs
+// from the size given to NewWriter.
+var ErrSizeMismatch = errors.New("Size of data differs from the declared size")
+
+// NewWriter returns a writer compressing exactly size bytes to w. Write returns
+// io.EOF when all the data is written. Writing more data fails with
+// ErrSizeMismatch, so does Close if less data is written.
+func NewWriter(w io.Writer, size int) io.WriteCloser {
 	if size < 0 || size > maxDataSize {
 		panic("Invalid size")
 	}
+	return newLZWriter(w, int32(size))
+}
 
+func newLZWriter(w io.Writer, size int32) *lzWriter {
 	return &lzWriter{
 		writer:       bufio.NewWriter(w),
-		originalSize: int32(size),
+		originalSize: size,
 		window:       make([]byte, windowSize*2),
 		blockPos:     -1,
 	}
@@ -92,7 +105,9 @@ func (lzw *lzWriter) writeByte() {
 }
 
 func (lzw *lzWriter) finishEncoding() {
-	if lzw.blockPos >= 0 {
+	if lzw.parser != nil {
+		lzw.parser.encode(lzw)
+	} else if lzw.blockPos >= 0 {
 		lzw.writeBlock(lzw.windowPos + 1)
 	} else {
 		lzw.writeByte()
@@ -106,16 +121,8 @@ func hash10(a, b byte) int {
 	return int((a << 2) ^ b)
 }
 
-func (lzw *lzWriter) Write(p []byte) (int, error) {
-	if lzw.err != nil || lzw.bw == nil && !lzw.init() {
-		return 0, lzw.err
-	}
-
-	data, remainingSize := p, int(lzw.originalSize-lzw.writedSize)
-	if len(p) > remainingSize {
-		data = p[:remainingSize]
-	}
-
+// encodeGreedy encodes data taking the first match found, see BestSpeed.
+func (lzw *lzWriter) encodeGreedy(data []byte) {
 	startOfs := 0
 	if lzw.writedSize == 0 && len(data) > 0 {
 		lzw.hashPrev[0] = windowSize
@@ -129,10 +136,10 @@ func (lzw *lzWriter) Write(p []byte) (int, error) {
 	maxBlockSize := int(blockSizeCoder.maxValue)
 	for _, b := range data[startOfs:] {
 		if lzw.err != nil {
-			return 0, lzw.err
+			return
 		}
 		if lzw.err = lzw.bw.flushBuffer(false); lzw.err != nil {
-			return 0, lzw.err
+			return
 		}
 
 		hash := hash10(lzw.prevByte, b)
@@ -190,9 +197,35 @@ func (lzw *lzWriter) Write(p []byte) (int, error) {
 	blockFound:
 		lzw.prevByte = b
 	}
+}
+
+func (lzw *lzWriter) Write(p []byte) (int, error) {
+	if errors.Is(lzw.err, io.EOF) && len(p) > 0 {
+		return 0, lzw.errTooLong()
+	}
+	if lzw.err != nil || lzw.bw == nil && !lzw.init() {
+		return 0, lzw.err
+	}
+
+	data, remainingSize := p, int(lzw.originalSize-lzw.writedSize)
+	if len(p) > remainingSize {
+		if lzw.streaming {
+			return 0, ErrTooLarge
+		}
+		data = p[:remainingSize]
+	}
+
+	if lzw.parser != nil {
+		lzw.parser.write(data, lzw)
+	} else {
+		lzw.encodeGreedy(data)
+	}
+	if lzw.err != nil {
+		return 0, lzw.err
+	}
 
 	lzw.writedSize += int32(len(data))
-	if lzw.writedSize == lzw.originalSize {
+	if lzw.writedSize == lzw.originalSize && !lzw.streaming {
 		lzw.finishEncoding()
 		if lzw.err == nil {
 			lzw.err = lzw.writer.Flush()
@@ -201,25 +234,64 @@ func (lzw *lzWriter) Write(p []byte) (int, error) {
 			lzw.err = io.EOF
 		}
 	}
+	if len(data) < len(p) && errors.Is(lzw.err, io.EOF) {
+		return len(data), lzw.errTooLong()
+	}
 
 	return len(data), lzw.err
 }
 
+func (lzw *lzWriter) errTooLong() error {
+	return fmt.Errorf("%w: data is longer than %d bytes", ErrSizeMismatch, lzw.originalSize)
+}
+
+// Close checks all the data has been written.
+func (lzw *lzWriter) Close() error {
+	if lzw.err == nil && lzw.writedSize == lzw.originalSize {
+		// Empty data is finished by the first write.
+		lzw.Write(nil)
+	}
+	if errors.Is(lzw.err, io.EOF) {
+		return nil
+	} else if lzw.err != nil {
+		return lzw.err
+	}
+	return fmt.Errorf("%w: %d of %d bytes are written", ErrSizeMismatch, lzw.writedSize, lzw.originalSize)
+}
+
+// lzReader decodes blocks right to the slice passed to Read and to the window.
+// A block which doesn't fit the slice is copied further by the next Read.
 type lzReader struct {
 	err          error
 	reader       io.Reader
 	br           *bitsReader
-	buf          bytes.Buffer
+	maxSize      int   // Limit of originalSize, negative if there is none
 	originalSize int32 // Size of uncompressed data
-	readedSize   int32
+	readedSize   int32 // Size of decoded blocks including the pending one
 	window       [windowSize]byte
 	windowPos    uint32
+	pendingSize  int // Bytes of the last block not copied yet
+	pendingDist  uint32
 }
 
+// ErrInvalidData is returned by readers if the compressed data is malformed.
 var ErrInvalidData = errors.New("Invalid data")
 
+// ErrTooLarge is returned by readers if the size of uncompressed data exceeds
+// the limit, see NewReaderLimit.
+var ErrTooLarge = errors.New("Uncompressed data is too large")
+
+// NewReader returns a reader decompressing data from r. Malformed data is
+// reported by ErrInvalidData or io.ErrUnexpectedEOF if it's truncated.
 func NewReader(r io.Reader) io.Reader {
-	return &lzReader{reader: bufio.NewReader(r)}
+	return NewReaderLimit(r, -1)
+}
+
+// NewReaderLimit is like NewReader, but fails with ErrTooLarge before
+// decompression if the data header declares more than maxSize bytes. The size
+// isn't limited if maxSize is negative.
+func NewReaderLimit(r io.Reader, maxSize int) io.Reader {
+	return &lzReader{reader: bufio.NewReader(r), maxSize: maxSize}
 }
 
 func (lzr *lzReader) init() bool {
@@ -231,45 +303,97 @@ func (lzr *lzReader) init() bool {
 	if lzr.err == nil && lzr.originalSize < 0 {
 		lzr.err = ErrInvalidData
 	}
+	if lzr.err == nil && lzr.maxSize >= 0 && int64(lzr.originalSize) > int64(lzr.maxSize) {
+		lzr.err = ErrTooLarge
+	}
 	return lzr.err == nil
 }
 
+// decodeBlock decodes the next block. A literal byte is stored to p, a block
+// becomes pending. It returns the number of bytes stored.
+func (lzr *lzReader) decodeBlock(p []byte) (int, error) {
+	blockSize, err := blockSizeCoder.decodeValue(lzr.br)
+	if err == nil && int64(lzr.readedSize)+int64(blockSize) > int64(lzr.originalSize) {
+		err = ErrInvalidData
+	}
+	n := 0
+	if err == nil && blockSize > 1 {
+		if lzr.pendingDist, err = distCoder.decodeValue(lzr.br); err == nil {
+			lzr.pendingSize = int(blockSize)
+		}
+	} else if err == nil {
+		b := lzr.br.readByte()
+		p[0] = b
+		lzr.window[lzr.windowPos] = b
+		lzr.windowPos = (lzr.windowPos + 1) & windowMask
+		n = 1
+	}
+	// Codes read past the end of data are garbage, so the end is reported.
+	if lzr.br.err != nil {
+		if errors.Is(lzr.br.err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, lzr.br.err
+	}
+	if err != nil {
+		return 0, err
+	}
+	lzr.readedSize += int32(blockSize)
+	return n, nil
+}
+
+// minCopySize is the size of blocks from which copy is faster than the loop.
+const minCopySize = 16
+
+// copyPending copies the pending block to p and the window as far as p allows.
+func (lzr *lzReader) copyPending(p []byte) int {
+	n := lzr.pendingSize
+	if n > len(p) {
+		n = len(p)
+	}
+	p = p[:n]
+	pos, src := int(lzr.windowPos), int((lzr.windowPos-lzr.pendingDist-1)&windowMask)
+	if n >= minCopySize && src+n <= windowSize && pos+n <= windowSize && (src+n <= pos || pos+n <= src) {
+		// Source and destination don't overlap nor wrap around the window.
+		copy(p, lzr.window[src:src+n])
+		copy(lzr.window[pos:], p)
+	} else {
+		for i := range p {
+			b := lzr.window[(src+i)&windowMask]
+			p[i] = b
+			lzr.window[(pos+i)&windowMask] = b
+		}
+	}
+	lzr.windowPos = uint32(pos+n) & windowMask
+	lzr.pendingSize -= n
+	return n
+}
+
 func (lzr *lzReader) Read(p []byte) (int, error) {
 	if lzr.err != nil || lzr.br == nil && !lzr.init() {
 		return 0, lzr.err
 	}
 
-	for lzr.readedSize < lzr.originalSize && lzr.buf.Len() < len(p) {
-		var blockSize, dist uint32
-		var b byte
-		blockSize = blockSizeCoder.decodeValue(lzr.br)
-		if blockSize > 1 {
-			dist = distCoder.decodeValue(lzr.br)
-			for i := uint32(0); i < blockSize; i++ {
-				pos := (lzr.windowPos - dist - 1) & windowMask
-				b = lzr.window[pos]
-				lzr.buf.WriteByte(b)
-				lzr.window[lzr.windowPos] = b
-				lzr.windowPos = (lzr.windowPos + 1) & windowMask
-			}
-		} else {
-			b = lzr.br.readByte()
-			lzr.buf.WriteByte(b)
-			lzr.window[lzr.windowPos] = b
-			lzr.windowPos = (lzr.windowPos + 1) & windowMask
+	n := 0
+	for n < len(p) {
+		if lzr.pendingSize > 0 {
+			n += lzr.copyPending(p[n:])
+			continue
 		}
-		if lzr.br.err != nil {
-			return 0, lzr.br.err
+		if lzr.readedSize == lzr.originalSize {
+			break
+		}
+		m, err := lzr.decodeBlock(p[n:])
+		n += m
+		if err != nil {
+			lzr.err = err
+			return n, err
 		}
-
-		lzr.readedSize += int32(blockSize)
 	}
-
-	n, err := lzr.buf.Read(p)
-	data := lzr.buf.Next(lzr.buf.Len())
-	lzr.buf.Reset()
-	lzr.buf.Write(data)
-	return n, err
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
 }
 
 func Compress(data []byte) []byte {
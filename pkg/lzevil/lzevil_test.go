@@ -2,7 +2,11 @@ package lzevil
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"testing"
+	"testing/iotest"
 )
 
 var testData = []byte("abcdabcdabcdabcd")
@@ -29,6 +33,18 @@ func rand(seed *int) int {
 	return ((*seed) >> 0x10) & 0x7FFF
 }
 
+func packLevel(t testing.TB, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriterLevel(&buf, len(data), level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
 func TestPackingConsistency(t *testing.T) {
 	bigData := make([]byte, 0x30000)
 	seed := 0
@@ -43,10 +59,96 @@ func TestPackingConsistency(t *testing.T) {
 	testsStrings := []string{"", "1", "11", "123123123", "123123123x", "1123xxxxx3211", string(bigData)}
 	for _, str := range testsStrings {
 		data := []byte(str)
-		packed := Compress(data)
-		unpacked, err := Decompress(packed)
-		if err != nil || !bytes.Equal(unpacked, data) {
-			t.FailNow()
+		for level := BestSpeed; level <= BestCompression; level++ {
+			packed := packLevel(t, data, level)
+			unpacked, err := Decompress(packed)
+			if err != nil || !bytes.Equal(unpacked, data) {
+				t.Fatalf("Data of %d bytes isn't unpacked at level %d: %v", len(data), level, err)
+			}
+		}
+	}
+}
+
+func TestUnpackingReads(t *testing.T) {
+	var data []byte
+	seed := 2
+	for len(data) < 3*windowSize {
+		data = append(data, []byte("Player")...)
+		for n := rand(&seed) % 8; n > 0; n-- {
+			data = append(data, byte(rand(&seed)))
+		}
+	}
+	packed := packLevel(t, data, BestCompression)
+	for _, readSize := range []int{1, 5, 300, 4096} {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader(packed)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			r = NewReader(r)
+			var unpacked []byte
+			buf := make([]byte, readSize)
+			var err error
+			for err == nil {
+				var n int
+				n, err = r.Read(buf)
+				unpacked = append(unpacked, buf[:n]...)
+			}
+			if err != io.EOF || !bytes.Equal(unpacked, data) {
+				t.Errorf("Data isn't unpacked by reads of %d bytes (one byte input %v): %v",
+					readSize, oneByte, err)
+			}
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	if !bytes.Equal(packLevel(t, testData, DefaultCompression), testPackedData) {
+		t.Error("Default level differs from NewWriter")
+	}
+	if _, err := NewWriterLevel(ioutil.Discard, 1, BestCompression+1); !errors.Is(err, ErrInvalidLevel) {
+		t.Errorf("Unexpected error of invalid level: %v", err)
+	}
+	if _, err := NewWriterLevel(ioutil.Discard, -1, BestSpeed); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("Unexpected error of invalid size: %v", err)
+	}
+
+	var data []byte
+	seed := 1
+	for len(data) < 3*chunkSize {
+		data = append(data, []byte("Server #")...)
+		data = append(data, byte('0'+rand(&seed)%10), byte('a'+rand(&seed)%26), 0, 0)
+	}
+	prevSize := 0
+	for level := BestSpeed; level <= BestCompression; level++ {
+		size := len(packLevel(t, data, level))
+		if prevSize > 0 && size > prevSize {
+			t.Errorf("Level %d packs worse than the previous one: %d > %d", level, size, prevSize)
+		}
+		prevSize = size
+	}
+}
+
+func TestUnpackingInvalid(t *testing.T) {
+	tests := []struct {
+		data        []byte
+		maxSize     int
+		expectedErr error
+	}{
+		{[]byte{0x10, 0x00}, -1, io.ErrUnexpectedEOF},
+		{testPackedData[:6], -1, io.ErrUnexpectedEOF},
+		{[]byte{0x10, 0x00, 0x00, 0x80}, -1, ErrInvalidData},
+		// The block of 2 bytes is longer than the data.
+		{[]byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00}, -1, ErrInvalidData},
+		{testPackedData, 15, ErrTooLarge},
+		{[]byte{0xff, 0xff, 0xff, 0x7f}, 1 << 20, ErrTooLarge},
+		{testPackedData, 16, nil},
+	}
+	for _, test := range tests {
+		_, err := ioutil.ReadAll(NewReaderLimit(bytes.NewReader(test.data), test.maxSize))
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("For % x unexpected err is '%v'. Expected err is '%v'",
+				test.data, err, test.expectedErr)
 		}
 	}
 }
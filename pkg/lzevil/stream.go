@@ -0,0 +1,116 @@
+package lzevil
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// streamWriter compresses data of unknown size. The data header is written
+// with maxDataSize first and is patched with the written size on Close, if
+// the target can seek. Files must also be regular and not opened for
+// appending, since writes to them ignore the position. Otherwise the
+// compressed data is spilled to a temporary file which is copied to the
+// target on Close.
+type streamWriter struct {
+	lzw    *lzWriter
+	target io.Writer
+	ws     io.WriteSeeker // target or spill
+	start  int64          // Position of the header in ws
+	spill  *os.File
+	closed bool
+	err    error
+}
+
+// NewStreamWriter returns a writer compressing data to w without knowing its
+// size beforehand. Close must be called to finish the data. Writes larger
+// than the format allows fail with ErrTooLarge.
+func NewStreamWriter(w io.Writer) io.WriteCloser {
+	sw := &streamWriter{target: w}
+	if ws, ok := w.(io.WriteSeeker); ok && patchable(w) {
+		if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			sw.ws, sw.start = ws, pos
+		}
+	}
+	if sw.ws == nil {
+		if sw.spill, sw.err = ioutil.TempFile("", "lzevil"); sw.err != nil {
+			return sw
+		}
+		sw.ws = sw.spill
+	}
+	sw.lzw = newLZWriter(sw.ws, maxDataSize)
+	sw.lzw.streaming = true
+	return sw
+}
+
+// patchable checks the header written to w can be patched. Files may be pipes
+// or devices, or they may be opened for appending, e.g. by shell redirection.
+func patchable(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return true
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular() && !appendMode(f)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.lzw.Write(p)
+	if err != nil {
+		sw.err = err
+	}
+	return n, err
+}
+
+// Close finishes the data and writes its size. It doesn't close the target.
+func (sw *streamWriter) Close() error {
+	if sw.closed {
+		return sw.err
+	}
+	sw.closed = true
+	if sw.spill != nil {
+		defer os.Remove(sw.spill.Name())
+		defer sw.spill.Close()
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+
+	lzw := sw.lzw
+	if lzw.bw != nil || lzw.init() {
+		lzw.finishEncoding()
+	}
+	if lzw.err == nil {
+		lzw.err = lzw.writer.Flush()
+	}
+	if sw.err = lzw.err; sw.err != nil {
+		return sw.err
+	}
+	sw.err = sw.patchSize()
+	if sw.err == nil && sw.spill != nil {
+		if _, sw.err = sw.spill.Seek(0, io.SeekStart); sw.err == nil {
+			_, sw.err = io.Copy(sw.target, sw.spill)
+		}
+	}
+	return sw.err
+}
+
+// patchSize writes the size of the data to its header.
+func (sw *streamWriter) patchSize() error {
+	end, err := sw.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.ws.Seek(sw.start, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(sw.ws, binary.LittleEndian, sw.lzw.writedSize); err != nil {
+		return err
+	}
+	_, err = sw.ws.Seek(end, io.SeekStart)
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd
+
+package lzevil
+
+import "os"
+
+// appendMode can't tell whether the file is opened with O_APPEND, so it's
+// assumed to be.
+func appendMode(f *os.File) bool {
+	return true
+}
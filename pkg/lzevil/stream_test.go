@@ -0,0 +1,112 @@
+package lzevil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamWriter(t *testing.T) {
+	for _, str := range []string{"", "1", "123123123x", string(bytes.Repeat(testData, 1000))} {
+		data := []byte(str)
+		expected := Compress(data)
+
+		// The target can't seek, the data is spilled.
+		var buf bytes.Buffer
+		w := NewStreamWriter(&buf)
+		for i := 0; i < len(data); i += 100 {
+			end := i + 100
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := w.Write(data[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil || !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("Unexpected data of %d bytes streamed to buffer: %v", len(data), err)
+		}
+
+		// The header is patched in the file after some other data.
+		f, err := os.Create(filepath.Join(t.TempDir(), "packed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("prefix"))
+		w = NewStreamWriter(f)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("suffix"))
+		f.Close()
+		written, _ := ioutil.ReadFile(f.Name())
+		if !bytes.Equal(written, append(append([]byte("prefix"), expected...), "suffix"...)) {
+			t.Errorf("Unexpected data of %d bytes streamed to file", len(data))
+		}
+	}
+}
+
+func TestStreamWriterAppend(t *testing.T) {
+	data := bytes.Repeat(testData, 100)
+	path := filepath.Join(t.TempDir(), "packed")
+	if err := ioutil.WriteFile(path, []byte("prefix"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to the file opened for appending ignore the position, so the
+	// header can't be patched and the data is spilled.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewStreamWriter(f)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	written, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(written, append([]byte("prefix"), Compress(data)...)) {
+		t.Errorf("Unexpected data appended to file: % x", written)
+	}
+}
+
+func TestWriterSizeMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, 4)
+	if n, err := w.Write([]byte("abcdef")); n != 4 || !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Longer data is written: %d %v", n, err)
+	}
+	if n, err := w.Write([]byte("g")); n != 0 || !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Data is written after the end: %d %v", n, err)
+	}
+	if unpacked, err := Decompress(buf.Bytes()); err != nil || string(unpacked) != "abcd" {
+		t.Errorf("Unexpected unpacked data: %q %v", unpacked, err)
+	}
+
+	w = NewWriter(&buf, 4)
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Shorter data is closed: %v", err)
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf, 0)
+	if err := w.Close(); err != nil || !bytes.Equal(buf.Bytes(), Compress(nil)) {
+		t.Errorf("Empty data isn't finished by Close: % x %v", buf.Bytes(), err)
+	}
+	if n, err := NewWriter(&buf, 1).Write([]byte("a")); n != 1 || err != io.EOF {
+		t.Errorf("Unexpected result of the last write: %d %v", n, err)
+	}
+}
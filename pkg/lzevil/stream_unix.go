@@ -0,0 +1,15 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd
+// +build linux darwin dragonfly freebsd netbsd
+
+package lzevil
+
+import (
+	"os"
+	"syscall"
+)
+
+// appendMode checks the file is opened with O_APPEND.
+func appendMode(f *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	return errno != 0 || flags&syscall.O_APPEND != 0
+}
@@ -0,0 +1,178 @@
+package masterserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Moderation endpoints are served with admin endpoints and require AdminToken
+// as bearer token. They are disabled if AdminToken is not set.
+
+func (s *Server) handleModeration(handler *http.ServeMux, prefix string) {
+	modPrefix := path.Join(prefix, "moderation")
+	handler.HandleFunc(modPrefix+"/bans", s.metrics.countRequests("moderation_bans",
+		s.adminOnly(s.serveBans)))
+	handler.HandleFunc(modPrefix+"/bans/", s.metrics.countRequests("moderation_ban",
+		s.adminOnly(s.serveBan)))
+	handler.HandleFunc(modPrefix+"/servers/", s.metrics.countRequests("moderation_server",
+		s.adminOnly(s.serveModeratedServer)))
+	handler.HandleFunc(modPrefix+"/audit", s.metrics.countRequests("moderation_audit",
+		s.adminOnly(s.serveAudit)))
+}
+
+// adminOnly checks the admin token before calling handler.
+func (s *Server) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.opts.AdminToken == "" {
+			writeJSON(w, http.StatusForbidden, &apiError{Error: "admin token is not set"})
+			return
+		}
+		if !hasToken(req, s.opts.AdminToken) {
+			writeJSON(w, http.StatusUnauthorized, &apiError{Error: "invalid admin token"})
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// hasToken checks the bearer token of the request in constant time.
+func hasToken(req *http.Request, token string) bool {
+	got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(val)
+}
+
+// audit records the moderation action.
+func (s *Server) audit(req *http.Request, action string, details interface{}) {
+	entry := auditEntry{Time: s.clock.Now(), Remote: req.RemoteAddr, Action: action, Details: details}
+	s.log.Infof("Moderation: %s by %s: %+v", action, req.RemoteAddr, details)
+	if err := s.moderation.record(entry); err != nil {
+		s.log.Errorf("Failed to write audit log: %s", err)
+	}
+}
+
+// serveBans lists bans or adds the ban. Registered servers matching the new
+// ban are removed. The ban is recorded to the audit log as soon as it's saved,
+// it's in effect even if the servers can't be removed now, their updates are
+// dropped and they expire.
+func (s *Server) serveBans(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.moderation.bans())
+	case http.MethodPost:
+		var rule banRule
+		if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: "invalid ban: " + err.Error()})
+			return
+		}
+		if err := rule.compile(); err != nil {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+			return
+		}
+		if err := s.moderation.addBan(&rule, s.clock.Now()); err != nil {
+			s.log.Errorf("Failed to save moderation file: %s", err)
+			writeJSON(w, http.StatusInternalServerError, &apiError{Error: "ban isn't saved: " + err.Error()})
+			return
+		}
+		s.audit(req, "ban", map[string]interface{}{"ban": &rule})
+		removed, err := s.removeServers(rule.matches)
+		if err != nil {
+			s.log.Warnf("Servers matching ban %d aren't removed: %s", rule.ID, err)
+		} else {
+			s.log.Infof("%d servers matching ban %d are removed", len(removed), rule.ID)
+		}
+		writeJSON(w, http.StatusCreated, &rule)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+	}
+}
+
+func (s *Server) serveBan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+		return
+	}
+	idStr := path.Base(req.URL.Path)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("invalid ban ID %q", idStr)})
+		return
+	}
+	found, err := s.moderation.removeBan(id)
+	if err != nil {
+		s.log.Errorf("Failed to save moderation file: %s", err)
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "ban isn't removed: " + err.Error()})
+		return
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("ban %d is not found", id)})
+		return
+	}
+	s.audit(req, "unban", map[string]interface{}{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveModeratedServer removes the registered server by DELETE or sets its
+// tags and pinned position by PUT.
+func (s *Server) serveModeratedServer(w http.ResponseWriter, req *http.Request) {
+	idStr := path.Base(req.URL.Path)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil || id == 0 {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("invalid server ID %q", idStr)})
+		return
+	}
+	switch req.Method {
+	case http.MethodDelete:
+		removed, err := s.removeServers(func(srv *master.EIServerInfo) bool { return srv.ID == id })
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: err.Error()})
+			return
+		}
+		if len(removed) == 0 {
+			writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("server %d is not found", id)})
+			return
+		}
+		s.audit(req, "remove", map[string]interface{}{"id": id, "server": removed[0].String()})
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		var mark serverMark
+		if err := json.NewDecoder(req.Body).Decode(&mark); err != nil || mark.Pinned < 0 {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: "invalid mark"})
+			return
+		}
+		if s.registry.Find(&master.EIServerInfo{ID: id}) == nil {
+			writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("server %d is not found", id)})
+			return
+		}
+		if err := s.moderation.setMark(id, &mark); err != nil {
+			s.log.Errorf("Failed to save moderation file: %s", err)
+			writeJSON(w, http.StatusInternalServerError, &apiError{Error: "mark isn't saved: " + err.Error()})
+			return
+		}
+		s.audit(req, "mark", map[string]interface{}{"id": id, "mark": &mark})
+		s.markChanged(id)
+		writeJSON(w, http.StatusOK, &mark)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+	}
+}
+
+func (s *Server) serveAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.moderation.recentAudit())
+}
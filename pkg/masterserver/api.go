@@ -0,0 +1,449 @@
+package masterserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// REST API v1. Lists are filtered, sorted and paginated by query parameters
+// described in openAPISpec. Every response has ETag, so clients polling the
+// API get 304 Not Modified until the data changes.
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiServersPage is the response of the list request.
+type apiServersPage struct {
+	Total   int                   `json:"total"`
+	Offset  int                   `json:"offset"`
+	Limit   int                   `json:"limit"`
+	Servers []master.EIServerInfo `json:"servers"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiSortKeys compare servers for sorting by the key.
+var apiSortKeys = map[string]func(a, b *master.EIServerInfo) bool{
+	"id":          func(a, b *master.EIServerInfo) bool { return a.ID < b.ID },
+	"name":        func(a, b *master.EIServerInfo) bool { return a.Name < b.Name },
+	"quest":       func(a, b *master.EIServerInfo) bool { return a.Quest < b.Quest },
+	"allod":       func(a, b *master.EIServerInfo) bool { return a.AllodIndex < b.AllodIndex },
+	"players":     func(a, b *master.EIServerInfo) bool { return a.PlayersCount < b.PlayersCount },
+	"ping":        func(a, b *master.EIServerInfo) bool { return a.Ping < b.Ping },
+	"appear_time": func(a, b *master.EIServerInfo) bool { return a.AppearTime.Before(b.AppearTime) },
+	"last_update": func(a, b *master.EIServerInfo) bool { return a.LastUpdate.Before(b.LastUpdate) },
+}
+
+func (s *Server) handleAPI(handler *http.ServeMux, prefix string) {
+	apiPrefix := path.Join(prefix, "api/v1")
+	handler.HandleFunc(apiPrefix+"/servers", s.metrics.countRequests("api_servers", s.serveAPIServers))
+	handler.HandleFunc(apiPrefix+"/servers/", s.metrics.countRequests("api_server", s.serveAPIServer))
+	handler.HandleFunc(apiPrefix+"/history", s.metrics.countRequests("api_history",
+		func(w http.ResponseWriter, req *http.Request) { s.serveAPIHistory(w, req, 0) }))
+	handler.HandleFunc(apiPrefix+"/players", s.metrics.countRequests("api_players", s.serveAPIPlayers))
+	handler.HandleFunc(apiPrefix+"/players/", s.metrics.countRequests("api_player", s.serveAPIPlayer))
+	handler.HandleFunc(apiPrefix+"/events", s.metrics.countRequests("api_events", s.serveEvents))
+	handler.HandleFunc(apiPrefix+"/openapi.json", s.metrics.countRequests("api_openapi", s.serveAPISpec))
+}
+
+// apiFilter parses filters of the list request.
+func apiFilter(query map[string][]string) (func(srv *master.EIServerInfo) bool, error) {
+	get := func(name string) string {
+		if vals := query[name]; len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	}
+	var filters []func(srv *master.EIServerInfo) bool
+
+	if val := get("allod"); val != "" {
+		allod, err := strconv.ParseUint(val, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allod %q", val)
+		}
+		filters = append(filters, func(srv *master.EIServerInfo) bool {
+			return srv.AllodIndex == uint8(allod)
+		})
+	}
+	if val := get("has_password"); val != "" {
+		hasPassword, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid has_password %q", val)
+		}
+		filters = append(filters, func(srv *master.EIServerInfo) bool {
+			return srv.HasPassword == hasPassword
+		})
+	}
+	if val := get("not_full"); val != "" {
+		notFull, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid not_full %q", val)
+		}
+		if notFull {
+			filters = append(filters, func(srv *master.EIServerInfo) bool {
+				return srv.PlayersCount < srv.MaxPlayersCount
+			})
+		}
+	}
+	if val := get("min_players"); val != "" {
+		minPlayers, err := strconv.ParseUint(val, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_players %q", val)
+		}
+		filters = append(filters, func(srv *master.EIServerInfo) bool {
+			return srv.PlayersCount >= uint8(minPlayers)
+		})
+	}
+	if val := strings.ToLower(get("name")); val != "" {
+		filters = append(filters, func(srv *master.EIServerInfo) bool {
+			return strings.Contains(strings.ToLower(srv.Name), val)
+		})
+	}
+	if val := strings.ToLower(get("quest")); val != "" {
+		filters = append(filters, func(srv *master.EIServerInfo) bool {
+			return strings.Contains(strings.ToLower(srv.Quest), val)
+		})
+	}
+
+	return func(srv *master.EIServerInfo) bool {
+		for _, filter := range filters {
+			if !filter(srv) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// sortServers sorts servers by the key from apiSortKeys, servers are sorted in
+// descending order if the key is prefixed by "-". Empty key means ID. Pinned
+// servers are always first.
+func sortServers(servers []master.EIServerInfo, sortKey string) error {
+	desc := false
+	if strings.HasPrefix(sortKey, "-") {
+		sortKey, desc = sortKey[1:], true
+	}
+	if sortKey == "" {
+		sortKey = "id"
+	}
+	less, ok := apiSortKeys[sortKey]
+	if !ok {
+		return fmt.Errorf("unknown sort key %q", sortKey)
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		if pinned, ok := pinnedLess(&servers[i], &servers[j]); ok {
+			return pinned
+		}
+		if desc {
+			return less(&servers[j], &servers[i])
+		}
+		return less(&servers[i], &servers[j])
+	})
+	return nil
+}
+
+// apiIntParam parses non-negative integer parameter or returns def if it's missing.
+func apiIntParam(query map[string][]string, name string, def int) (int, error) {
+	vals := query[name]
+	if len(vals) == 0 || vals[0] == "" {
+		return def, nil
+	}
+	val, err := strconv.Atoi(vals[0])
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, vals[0])
+	}
+	return val, nil
+}
+
+func (s *Server) serveAPIServers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.writeAPIError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	filter, err := apiFilter(query)
+	if err != nil {
+		s.writeAPIError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, err := apiIntParam(query, "offset", 0)
+	if err != nil {
+		s.writeAPIError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := apiIntParam(query, "limit", apiDefaultLimit)
+	if err != nil || limit > apiMaxLimit {
+		s.writeAPIError(w, req, http.StatusBadRequest,
+			fmt.Sprintf("limit must be between 0 and %d", apiMaxLimit))
+		return
+	}
+
+	servers := []master.EIServerInfo{}
+	for _, srv := range s.visibleServers() {
+		if filter(&srv) {
+			servers = append(servers, srv)
+		}
+	}
+	if err := sortServers(servers, query.Get("sort")); err != nil {
+		s.writeAPIError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page := apiServersPage{Total: len(servers), Offset: offset, Limit: limit}
+	if offset > len(servers) {
+		offset = len(servers)
+	}
+	if offset+limit < len(servers) {
+		servers = servers[:offset+limit]
+	}
+	page.Servers = servers[offset:]
+	s.writeAPIResponse(w, req, http.StatusOK, &page)
+}
+
+func (s *Server) serveAPIServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.writeAPIError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	urlPath, withHistory := req.URL.Path, false
+	if path.Base(urlPath) == "history" {
+		urlPath, withHistory = path.Dir(urlPath), true
+	}
+	idStr := path.Base(urlPath)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil || id == 0 {
+		s.writeAPIError(w, req, http.StatusNotFound, fmt.Sprintf("invalid server ID %q", idStr))
+		return
+	}
+	if withHistory {
+		s.serveAPIHistory(w, req, id)
+		return
+	}
+	for _, srv := range s.visibleServers() {
+		if srv.ID == id {
+			s.writeAPIResponse(w, req, http.StatusOK, &srv)
+			return
+		}
+	}
+	s.writeAPIError(w, req, http.StatusNotFound, fmt.Sprintf("server %d is not found", id))
+}
+
+// apiHistory is the response of history requests. Availability is the share
+// of time the server was visible and uptime is the share of that time it
+// answered pings, both in percents. They are set for server series only.
+type apiHistory struct {
+	ID           uint64            `json:"id,omitempty"`
+	Resolution   string            `json:"resolution"`
+	Availability *float64          `json:"availability,omitempty"`
+	Uptime       *float64          `json:"uptime,omitempty"`
+	Points       []apiHistoryPoint `json:"points"`
+}
+
+type apiHistoryPoint struct {
+	Time       time.Time `json:"time"`
+	PlayersAvg float64   `json:"players_avg"`
+	PlayersMax uint32    `json:"players_max"`
+	ServersAvg float64   `json:"servers_avg,omitempty"`
+}
+
+// apiTimeParam parses RFC 3339 time parameter. Zero time is returned if it's missing.
+func apiTimeParam(query map[string][]string, name string) (time.Time, error) {
+	vals := query[name]
+	if len(vals) == 0 || vals[0] == "" {
+		return time.Time{}, nil
+	}
+	val, err := time.Parse(time.RFC3339, vals[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q", name, vals[0])
+	}
+	return val, nil
+}
+
+// serveAPIHistory serves the series of the server or the global one if id is 0.
+func (s *Server) serveAPIHistory(w http.ResponseWriter, req *http.Request, id uint64) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.writeAPIError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	resolution := query.Get("resolution")
+	if resolution == "" && len(s.history.tiers) > 0 {
+		resolution = s.history.tiers[0].Name
+	}
+	tier := s.history.tier(resolution)
+	if tier < 0 {
+		s.writeAPIError(w, req, http.StatusBadRequest, fmt.Sprintf("unknown resolution %q", resolution))
+		return
+	}
+	from, err := apiTimeParam(query, "from")
+	if err != nil {
+		s.writeAPIError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := apiTimeParam(query, "to")
+	if err != nil {
+		s.writeAPIError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	points := s.history.points(id, tier, from, to)
+	if id != 0 && points == nil {
+		s.writeAPIError(w, req, http.StatusNotFound, fmt.Sprintf("no history of server %d", id))
+		return
+	}
+	resp := apiHistory{ID: id, Resolution: resolution, Points: make([]apiHistoryPoint, 0, len(points))}
+	var samples, reachable uint64
+	for _, p := range points {
+		if p.Samples == 0 {
+			continue
+		}
+		resp.Points = append(resp.Points, apiHistoryPoint{
+			Time:       time.Unix(p.Time, 0).UTC(),
+			PlayersAvg: float64(p.Players) / float64(p.Samples),
+			PlayersMax: p.MaxPlayers,
+			ServersAvg: float64(p.Servers) / float64(p.Samples),
+		})
+		samples += uint64(p.Samples)
+		reachable += uint64(p.Reachable)
+	}
+	if id != 0 && samples > 0 {
+		// The server is considered known since its first point.
+		var total uint64
+		for _, p := range s.history.points(0, tier, time.Unix(points[0].Time, 0), to) {
+			total += uint64(p.Samples)
+		}
+		availability := 100 * float64(samples) / float64(total)
+		if availability > 100 {
+			availability = 100
+		}
+		uptime := 100 * float64(reachable) / float64(samples)
+		resp.Availability, resp.Uptime = &availability, &uptime
+	}
+	s.writeAPIResponse(w, req, http.StatusOK, &resp)
+}
+
+// apiPlayersPage is the response of player search.
+type apiPlayersPage struct {
+	Total   int              `json:"total"`
+	Players []playerPresence `json:"players"`
+}
+
+func (s *Server) serveAPIPlayers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.writeAPIError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	online := false
+	if val := query.Get("online"); val != "" {
+		var err error
+		if online, err = strconv.ParseBool(val); err != nil {
+			s.writeAPIError(w, req, http.StatusBadRequest, fmt.Sprintf("invalid online %q", val))
+			return
+		}
+	}
+	limit, err := apiIntParam(query, "limit", apiDefaultLimit)
+	if err != nil || limit > apiMaxLimit {
+		s.writeAPIError(w, req, http.StatusBadRequest,
+			fmt.Sprintf("limit must be between 0 and %d", apiMaxLimit))
+		return
+	}
+
+	players := s.players.search(query.Get("q"), online)
+	page := apiPlayersPage{Total: len(players), Players: players}
+	if limit < len(players) {
+		page.Players = players[:limit]
+	}
+	s.writeAPIResponse(w, req, http.StatusOK, &page)
+}
+
+func (s *Server) serveAPIPlayer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.writeAPIError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := path.Base(req.URL.Path)
+	if p := s.players.find(name); p != nil {
+		s.writeAPIResponse(w, req, http.StatusOK, p)
+		return
+	}
+	s.writeAPIError(w, req, http.StatusNotFound, fmt.Sprintf("player %q is not found", name))
+}
+
+func (s *Server) serveAPISpec(w http.ResponseWriter, req *http.Request) {
+	s.writeAPIResponse(w, req, http.StatusOK, json.RawMessage(openAPISpec))
+}
+
+func (s *Server) writeAPIError(w http.ResponseWriter, req *http.Request, status int, msg string) {
+	s.writeAPIResponse(w, req, status, &apiError{Error: msg})
+}
+
+// writeAPIResponse sends val as JSON. Successful responses are not sent if
+// the client has the same version. The response is compressed if the client
+// accepts gzip.
+func (s *Server) writeAPIResponse(w http.ResponseWriter, req *http.Request, status int, val interface{}) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		s.log.Errorf("Failed to convert API response to JSON: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Content-Type", "application/json")
+	header.Add("Vary", "Accept-Encoding")
+	if status == http.StatusOK {
+		hash := fnv.New64a()
+		hash.Write(data)
+		etag := fmt.Sprintf(`"%016x"`, hash.Sum64())
+		header.Set("ETag", etag)
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		data = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(data); err != nil {
+		s.log.Errorf("Failed write HTTP response: %s", err)
+	}
+}
+
+// etagMatches checks If-None-Match header which is a list of ETags or "*".
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, val := range strings.Split(ifNoneMatch, ",") {
+		val = strings.TrimPrefix(strings.TrimSpace(val), "W/")
+		if val == etag || val == "*" {
+			return true
+		}
+	}
+	return false
+}
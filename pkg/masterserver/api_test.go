@@ -0,0 +1,134 @@
+package masterserver
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func apiGet(t *testing.T, srv *Server, url string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIServers(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	games := []master.EIGameInfo{
+		{ClientID: 1, Name: "Alpha", Quest: "Quest one", PlayersCount: 1, MaxPlayersCount: 4, AllodIndex: 1},
+		{ClientID: 2, Name: "Beta", Quest: "Quest two", PlayersCount: 4, MaxPlayersCount: 4, AllodIndex: 2},
+		{ClientID: 3, Name: "Gamma", Quest: "Other", PlayersCount: 2, MaxPlayersCount: 4,
+			AllodIndex: 1, HasPassword: true},
+	}
+	for i := range games {
+		games[i].PlayerNames = []string{}
+		sendGame(t, srv, &games[i])
+	}
+	waitForServers(t, srv, clock, len(games))
+
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"Alpha", "Beta", "Gamma"}},
+		{"allod=1", []string{"Alpha", "Gamma"}},
+		{"has_password=false", []string{"Alpha", "Beta"}},
+		{"not_full=true", []string{"Alpha", "Gamma"}},
+		{"min_players=2", []string{"Beta", "Gamma"}},
+		{"name=ALP", []string{"Alpha"}},
+		{"quest=quest", []string{"Alpha", "Beta"}},
+		{"sort=-players", []string{"Beta", "Gamma", "Alpha"}},
+		{"sort=name&offset=1&limit=1", []string{"Beta"}},
+		{"offset=5", []string{}},
+	}
+	for _, test := range tests {
+		// Games may be registered in any order, so IDs are not predictable
+		url := "/api/v1/servers?" + test.query
+		if !strings.Contains(test.query, "sort=") {
+			url += "&sort=name"
+		}
+		w := apiGet(t, srv, url, nil)
+		var page apiServersPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Query %q failed: %d %s", test.query, w.Code, w.Body)
+		}
+		names := []string{}
+		for _, srv := range page.Servers {
+			names = append(names, srv.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(test.names) {
+			t.Errorf("Query %q returned %v, expected %v", test.query, names, test.names)
+		}
+	}
+
+	for _, query := range []string{"allod=x", "sort=unknown", "limit=5000", "offset=-1"} {
+		if w := apiGet(t, srv, "/api/v1/servers?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Query %q is accepted: %d", query, w.Code)
+		}
+	}
+}
+
+func TestAPIServersEmpty(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	for _, query := range []string{"", "name=nobody"} {
+		w := apiGet(t, srv, "/api/v1/servers?"+query, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"servers":[]`) {
+			t.Errorf("Query %q returned no empty array: %d %s", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayerNames: []string{}})
+	servers := waitForServers(t, srv, clock, 1)
+
+	w := apiGet(t, srv, fmt.Sprintf("/api/v1/servers/%d", servers[0].ID), nil)
+	var got master.EIServerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Name != "Alpha" {
+		t.Fatalf("Unexpected server: %d %s", w.Code, w.Body)
+	}
+	for _, url := range []string{"/api/v1/servers/100", "/api/v1/servers/abc"} {
+		if w := apiGet(t, srv, url, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Unexpected status of %s: %d", url, w.Code)
+		}
+	}
+
+	// Conditional request
+	etag := w.Header().Get("ETag")
+	w = apiGet(t, srv, fmt.Sprintf("/api/v1/servers/%d", servers[0].ID),
+		http.Header{"If-None-Match": {etag}})
+	if etag == "" || w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Unexpected response to conditional request: %d %q", w.Code, etag)
+	}
+
+	// Compression
+	w = apiGet(t, srv, "/api/v1/servers", http.Header{"Accept-Encoding": {"gzip"}})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Response isn't compressed")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page apiServersPage
+	if err := json.NewDecoder(gz).Decode(&page); err != nil || page.Total != 1 {
+		t.Errorf("Unexpected compressed response: %v %+v", err, page)
+	}
+
+	if w := apiGet(t, srv, "/api/v1/openapi.json", nil); w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("Invalid OpenAPI description: %d", w.Code)
+	}
+}
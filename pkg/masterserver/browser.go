@@ -0,0 +1,132 @@
+package masterserver
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// The server browser is a plain HTML page listing visible servers. It's
+// reloaded by the browser every browserRefresh, columns are sorted by the
+// sort parameter the same way as in the API.
+
+const browserRefresh = 30 * time.Second
+
+type browserColumn struct {
+	Title   string
+	SortKey string // Empty if the column isn't sortable
+}
+
+var browserColumns = []browserColumn{
+	{"Name", "name"},
+	{"Quest", "quest"},
+	{"Allod", "allod"},
+	{"Players", "players"},
+	{"Password", ""},
+	{"Ping", "ping"},
+	{"Uptime", "appear_time"},
+}
+
+type browserPage struct {
+	Columns []browserColumn
+	Sort    string
+	Refresh int
+	Now     time.Time
+	Servers []master.EIServerInfo
+}
+
+var browserTemplate = template.Must(template.New("browser").Funcs(template.FuncMap{
+	"uptime": func(now, appear time.Time) string {
+		d := now.Sub(appear).Round(time.Minute)
+		return fmt.Sprintf("%dh %02dm", int(d.Hours()), int(d.Minutes())%60)
+	},
+	// sortLink toggles the order if the column is already sorted ascending.
+	"sortLink": func(cur, key string) string {
+		if cur == key {
+			return "-" + key
+		}
+		return key
+	},
+}).Parse(browserHTML))
+
+const browserHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Evil Islands servers</title>
+<style>` + browserCSS + `</style>
+</head>
+<body>
+<h1>Evil Islands servers</h1>
+<p>{{len .Servers}} servers online. The page is refreshed every {{.Refresh}} seconds.</p>
+<table>
+<tr>
+{{- range .Columns}}
+<th>{{if .SortKey}}<a href="?sort={{sortLink $.Sort .SortKey}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}</th>
+{{- end}}
+</tr>
+{{- range .Servers}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Quest}}</td>
+<td>{{.AllodIndex}}</td>
+<td>{{if .PlayerNames}}<details><summary>{{.PlayersCount}} / {{.MaxPlayersCount}}</summary>
+<ul>{{range .PlayerNames}}<li>{{.}}</li>{{end}}</ul></details>
+{{- else}}{{.PlayersCount}} / {{.MaxPlayersCount}}{{end}}</td>
+<td>{{if .HasPassword}}yes{{else}}no{{end}}</td>
+<td>{{if gt .Ping 0}}{{.Ping}} ms{{else}}-{{end}}</td>
+<td>{{uptime $.Now .AppearTime}}</td>
+</tr>
+{{- else}}
+<tr><td colspan="{{len .Columns}}">No servers</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`
+
+const browserCSS = `
+body { font-family: sans-serif; margin: 2em; background: #f4f1ea; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 0.4em 0.8em; border-bottom: 1px solid #ccc; text-align: left; vertical-align: top; }
+th { background: #3b3224; }
+th, th a { color: #f4f1ea; }
+tr:hover td { background: #e8e2d4; }
+details ul { margin: 0.3em 0; padding-left: 1.2em; }
+summary { cursor: pointer; }
+`
+
+func (s *Server) serveBrowser(w http.ResponseWriter, req *http.Request) {
+	sortKey := req.URL.Query().Get("sort")
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	servers := s.visibleServers()
+	if err := sortServers(servers, sortKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := browserPage{
+		Columns: browserColumns,
+		Sort:    sortKey,
+		Refresh: int(browserRefresh.Seconds()),
+		Now:     s.clock.Now(),
+		Servers: servers,
+	}
+	var buf bytes.Buffer
+	if err := browserTemplate.Execute(&buf, &page); err != nil {
+		s.log.Errorf("Failed to render server browser: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		s.log.Errorf("Failed write HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+package masterserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestBrowser(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{
+		Clock:  clock,
+		Config: Config{VisibleFor: 2 * time.Hour, ExpireAfter: 2 * time.Hour},
+	})
+	sendGame(t, srv, &master.EIGameInfo{
+		ClientID:        1,
+		Name:            "Сервер",
+		Quest:           "<b>Квест</b>",
+		PlayersCount:    1,
+		MaxPlayersCount: 4,
+		PlayerNames:     []string{"Игрок"},
+	})
+	waitForServers(t, srv, clock, 1)
+	clock.Advance(time.Hour)
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/browser?sort=-players", nil))
+	body := w.Body.String()
+	if w.Code != 200 || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	for _, s := range []string{"Сервер", "&lt;b&gt;Квест&lt;/b&gt;", "<li>Игрок</li>", "1 / 4",
+		`href="?sort=players"`, "1h 0"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Page doesn't contain %q:\n%s", s, body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/browser?sort=unknown", nil))
+	if w.Code != 400 {
+		t.Errorf("Unknown sort key is accepted: %d", w.Code)
+	}
+}
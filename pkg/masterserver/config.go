@@ -0,0 +1,212 @@
+package masterserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config holds the settings of a running server which can be changed without
+// restart, see Server.SetConfig. Zero fields are replaced with defaults. Limits
+// are disabled by negative values.
+type Config struct {
+	RefreshInterval  time.Duration // How often the servers list is refreshed
+	VisibleFor       time.Duration // How long a server is sent to clients after its last update
+	ExpireAfter      time.Duration // How long a server is kept after its last update
+	PingTimeout      time.Duration // How long to wait for the ping reply
+	PingInterval     time.Duration // How often game servers are pinged
+	PingMaxInterval  time.Duration // How often unreachable game servers are pinged at least
+	ClientIDTimeout  time.Duration // How long to wait for client ID before sending the list
+	WriteTimeout     time.Duration // Deadline for sending the list
+	SendDelay        time.Duration // Delay before closing connection after sending the list
+	SnapshotInterval time.Duration // How often the registry snapshot is saved
+
+	PacketRate          float64 // UDP packets per second allowed from one IP
+	PacketBurst         int     // UDP packets allowed from one IP at once
+	MaxServersPerIP     int     // Servers registered from one IP
+	MaxServersPerSubnet int     // Servers registered from one /24 (IPv4) or /64 (IPv6) network
+	MaxServers          int     // Servers registered on this master, copies from peers and mirrors are not counted
+	EvictionPolicy      string  // What to do when the registry is full: EvictOldest or EvictReject
+	MaxCopies           int     // Copies from peers and mirrors, new ones are rejected over it
+
+	// StrictTokens requires updates from the original game to echo MasterToken
+	// issued to the host. Updates without valid token only get a new token.
+	StrictTokens bool
+
+	PeerSyncInterval time.Duration // How often peers are polled for changes
+	PeerMaxHops      int           // How many times an entry may be relayed between peers
+
+	MirrorInterval time.Duration // How often upstream masters are polled for their lists
+	MirrorTTL      time.Duration // How long a mirrored server is kept after it's gone from upstream
+
+	MaxEndpoints int // Candidate addresses kept per server
+
+	// Content policy of strings sent by game servers, see policy.go. Lengths
+	// are in characters. BannedWords are matched ignoring case and look-alike
+	// characters.
+	MaxNameLength  int
+	MaxQuestLength int
+	MaxNickLength  int
+	BannedWords    []string
+	ContentPolicy  string // PolicyRewrite or PolicyReject
+}
+
+// DefaultConfig returns the settings used for zero Config fields.
+func DefaultConfig() Config {
+	return Config{
+		RefreshInterval:  15 * time.Second,
+		VisibleFor:       2 * time.Minute,
+		ExpireAfter:      30 * time.Minute,
+		PingTimeout:      2500 * time.Millisecond,
+		PingInterval:     30 * time.Second,
+		PingMaxInterval:  5 * time.Minute,
+		ClientIDTimeout:  1 * time.Second,
+		WriteTimeout:     5 * time.Second,
+		SendDelay:        100 * time.Millisecond,
+		SnapshotInterval: 1 * time.Minute,
+
+		PacketRate:          2,
+		PacketBurst:         20,
+		MaxServersPerIP:     16,
+		MaxServersPerSubnet: 64,
+		MaxServers:          4096,
+		EvictionPolicy:      EvictOldest,
+		MaxCopies:           4096,
+
+		PeerSyncInterval: 10 * time.Second,
+		PeerMaxHops:      3,
+
+		MirrorInterval: 30 * time.Second,
+		MirrorTTL:      2 * time.Minute,
+
+		MaxEndpoints: 4,
+
+		MaxNameLength:  64,
+		MaxQuestLength: 64,
+		MaxNickLength:  32,
+		ContentPolicy:  PolicyRewrite,
+	}
+}
+
+func (cfg *Config) fillDefaults() {
+	def := DefaultConfig()
+	fields := []struct{ val, def *time.Duration }{
+		{&cfg.RefreshInterval, &def.RefreshInterval},
+		{&cfg.VisibleFor, &def.VisibleFor},
+		{&cfg.ExpireAfter, &def.ExpireAfter},
+		{&cfg.PingTimeout, &def.PingTimeout},
+		{&cfg.PingInterval, &def.PingInterval},
+		{&cfg.PingMaxInterval, &def.PingMaxInterval},
+		{&cfg.ClientIDTimeout, &def.ClientIDTimeout},
+		{&cfg.WriteTimeout, &def.WriteTimeout},
+		{&cfg.SendDelay, &def.SendDelay},
+		{&cfg.SnapshotInterval, &def.SnapshotInterval},
+		{&cfg.PeerSyncInterval, &def.PeerSyncInterval},
+		{&cfg.MirrorInterval, &def.MirrorInterval},
+		{&cfg.MirrorTTL, &def.MirrorTTL},
+	}
+	for _, f := range fields {
+		if *f.val == 0 {
+			*f.val = *f.def
+		}
+	}
+	intFields := []struct{ val, def *int }{
+		{&cfg.PacketBurst, &def.PacketBurst},
+		{&cfg.MaxServersPerIP, &def.MaxServersPerIP},
+		{&cfg.MaxServersPerSubnet, &def.MaxServersPerSubnet},
+		{&cfg.MaxServers, &def.MaxServers},
+		{&cfg.MaxCopies, &def.MaxCopies},
+		{&cfg.PeerMaxHops, &def.PeerMaxHops},
+		{&cfg.MaxNameLength, &def.MaxNameLength},
+		{&cfg.MaxQuestLength, &def.MaxQuestLength},
+		{&cfg.MaxNickLength, &def.MaxNickLength},
+		{&cfg.MaxEndpoints, &def.MaxEndpoints},
+	}
+	for _, f := range intFields {
+		if *f.val == 0 {
+			*f.val = *f.def
+		}
+	}
+	if cfg.PacketRate == 0 {
+		cfg.PacketRate = def.PacketRate
+	}
+	if cfg.EvictionPolicy == "" {
+		cfg.EvictionPolicy = def.EvictionPolicy
+	}
+	if cfg.ContentPolicy == "" {
+		cfg.ContentPolicy = def.ContentPolicy
+	}
+}
+
+// Validate checks the settings are consistent. Zero fields are valid.
+func (cfg *Config) Validate() error {
+	c := *cfg
+	c.fillDefaults()
+	durations := []struct {
+		name string
+		val  time.Duration
+	}{
+		{"refresh interval", c.RefreshInterval},
+		{"visible for", c.VisibleFor},
+		{"expire after", c.ExpireAfter},
+		{"ping timeout", c.PingTimeout},
+		{"ping interval", c.PingInterval},
+		{"ping max interval", c.PingMaxInterval},
+		{"client ID timeout", c.ClientIDTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"send delay", c.SendDelay},
+		{"snapshot interval", c.SnapshotInterval},
+		{"peer sync interval", c.PeerSyncInterval},
+		{"mirror interval", c.MirrorInterval},
+		{"mirror TTL", c.MirrorTTL},
+	}
+	for _, d := range durations {
+		if d.val < 0 {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+	}
+	if c.VisibleFor > c.ExpireAfter {
+		return errors.New("servers must be visible not longer than they are kept")
+	}
+	if c.PingInterval > c.PingMaxInterval {
+		return errors.New("ping interval must not exceed max ping interval")
+	}
+	if c.PacketRate > 0 && c.PacketBurst < 1 {
+		return errors.New("packet burst must be positive if packet rate is limited")
+	}
+	if c.EvictionPolicy != EvictOldest && c.EvictionPolicy != EvictReject {
+		return fmt.Errorf("unknown eviction policy %q", c.EvictionPolicy)
+	}
+	if c.ContentPolicy != PolicyRewrite && c.ContentPolicy != PolicyReject {
+		return fmt.Errorf("unknown content policy %q", c.ContentPolicy)
+	}
+	return nil
+}
+
+// SetConfig applies new settings to the server. It may be called while the
+// server is running, the registry is kept as is.
+func (s *Server) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cfg.fillDefaults()
+
+	policy := newContentPolicy(&cfg)
+	s.cfgMu.Lock()
+	s.cfg, s.policy = cfg, policy
+	s.cfgMu.Unlock()
+
+	// Let the maintainer know the refresh interval may be changed.
+	select {
+	case s.cfgChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Config returns the current settings of the server.
+func (s *Server) Config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
@@ -0,0 +1,127 @@
+package masterserver
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Every local server keeps the addresses its updates came from as candidate
+// endpoints, e.g. the address behind NAT and the public one, or addresses of
+// several network interfaces. All endpoints are pinged and the published
+// address is chosen by selectEndpoint which depends on the entry only, so the
+// same history gives the same choice on every master.
+
+// endpointsOf returns the endpoints of the server. Entries stored before
+// endpoints were tracked get one endpoint with their published address.
+func endpointsOf(srv *master.EIServerInfo) []master.EIServerEndpoint {
+	if len(srv.Endpoints) > 0 {
+		return srv.Endpoints
+	}
+	return []master.EIServerEndpoint{{
+		Addr:               srv.Addr,
+		FirstSeen:          srv.AppearTime,
+		LastSeen:           srv.LastUpdate,
+		PingStats:          srv.PingStats,
+		LastSuccessfulPing: srv.LastSuccessfulPing,
+	}}
+}
+
+// seeEndpoint records the update of the server from addr.
+func seeEndpoint(srv *master.EIServerInfo, addr net.UDPAddr, now time.Time) {
+	if endpoint := srv.Endpoint(&addr); endpoint != nil {
+		endpoint.LastSeen = now
+		return
+	}
+	srv.Endpoints = append(srv.Endpoints, master.EIServerEndpoint{
+		Addr:      addr,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+}
+
+// pruneEndpoints removes endpoints which have been neither seen nor answered
+// since before and the least recently seen endpoints over max. Max is not
+// applied if it's negative. Removed endpoints are returned.
+func pruneEndpoints(srv *master.EIServerInfo, before time.Time, max int) []master.EIServerEndpoint {
+	var kept, removed []master.EIServerEndpoint
+	for _, endpoint := range srv.Endpoints {
+		if endpoint.LastSeen.Before(before) && endpoint.LastSuccessfulPing.Before(before) {
+			removed = append(removed, endpoint)
+		} else {
+			kept = append(kept, endpoint)
+		}
+	}
+	if max >= 0 && len(kept) > max {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return kept[i].LastSeen.After(kept[j].LastSeen)
+		})
+		removed = append(removed, kept[max:]...)
+		kept = kept[:max]
+	}
+	srv.Endpoints = kept
+	return removed
+}
+
+// endpointBetter is the order of endpoints by preference. Endpoints answered
+// since reachableSince come first, they are ordered by rounded RTT and loss.
+// Otherwise the most recently seen endpoint is preferred. Addresses break ties.
+func endpointBetter(a, b *master.EIServerEndpoint, reachableSince time.Time) bool {
+	aReachable := !a.LastSuccessfulPing.Before(reachableSince)
+	bReachable := !b.LastSuccessfulPing.Before(reachableSince)
+	if aReachable != bReachable {
+		return aReachable
+	}
+	if aReachable {
+		if a.PingStats.Ping() != b.PingStats.Ping() {
+			return a.PingStats.Ping() < b.PingStats.Ping()
+		}
+		if a.PingStats.Loss != b.PingStats.Loss {
+			return a.PingStats.Loss < b.PingStats.Loss
+		}
+	}
+	if !a.LastSeen.Equal(b.LastSeen) {
+		return a.LastSeen.After(b.LastSeen)
+	}
+	return a.Addr.String() < b.Addr.String()
+}
+
+// selectEndpoint publishes the best endpoint of the server: its address and
+// ping results are copied to the entry.
+func selectEndpoint(srv *master.EIServerInfo, reachableSince time.Time) {
+	if len(srv.Endpoints) == 0 {
+		return
+	}
+	best := &srv.Endpoints[0]
+	for i := 1; i < len(srv.Endpoints); i++ {
+		if endpointBetter(&srv.Endpoints[i], best, reachableSince) {
+			best = &srv.Endpoints[i]
+		}
+	}
+	srv.Addr = best.Addr
+	srv.Ping = best.PingStats.Ping()
+	srv.PingStats = best.PingStats
+	srv.LastSuccessfulPing = best.LastSuccessfulPing
+}
+
+// gameAddr returns the address of the server to be sent to games, which only
+// know IPv4. It's the published address if it's IPv4, otherwise the best IPv4
+// endpoint. False is returned if the server has no IPv4 address.
+func gameAddr(srv *master.EIServerInfo, reachableSince time.Time) (net.UDPAddr, bool) {
+	if srv.Addr.IP.To4() != nil {
+		return srv.Addr, true
+	}
+	var best *master.EIServerEndpoint
+	for i := range srv.Endpoints {
+		endpoint := &srv.Endpoints[i]
+		if endpoint.Addr.IP.To4() != nil && (best == nil || endpointBetter(endpoint, best, reachableSince)) {
+			best = endpoint
+		}
+	}
+	if best == nil {
+		return net.UDPAddr{}, false
+	}
+	return best.Addr, true
+}
@@ -0,0 +1,75 @@
+package masterserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestSelectEndpoint(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	addr := func(port int) net.UDPAddr {
+		return net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+	}
+	srv := &master.EIServerInfo{}
+	seeEndpoint(srv, addr(1), now.Add(-time.Hour))
+	seeEndpoint(srv, addr(2), now.Add(-2*time.Minute))
+	seeEndpoint(srv, addr(3), now.Add(-time.Minute))
+	seeEndpoint(srv, addr(2), now)
+	if len(srv.Endpoints) != 3 || !srv.Endpoints[1].LastSeen.Equal(now) {
+		t.Fatalf("Unexpected endpoints: %+v", srv.Endpoints)
+	}
+
+	// No endpoint answers, the most recently seen one is published.
+	selectEndpoint(srv, now.Add(-time.Minute))
+	if srv.Addr.Port != 2 {
+		t.Errorf("Unexpected published address: %s", &srv.Addr)
+	}
+
+	srv.Endpoints[0].PingStats.AddReply(100 * time.Millisecond)
+	srv.Endpoints[0].LastSuccessfulPing = now
+	srv.Endpoints[2].PingStats.AddReply(50 * time.Millisecond)
+	srv.Endpoints[2].LastSuccessfulPing = now.Add(-2 * time.Minute)
+	selectEndpoint(srv, now.Add(-time.Minute))
+	if srv.Addr.Port != 1 || srv.Ping != 100 || !srv.LastSuccessfulPing.Equal(now) {
+		t.Errorf("Reachable endpoint isn't published: %+v", srv)
+	}
+	srv.Endpoints[2].LastSuccessfulPing = now
+	selectEndpoint(srv, now.Add(-time.Minute))
+	if srv.Addr.Port != 3 || srv.Ping != 50 {
+		t.Errorf("Faster endpoint isn't published: %+v", srv)
+	}
+
+	removed := pruneEndpoints(srv, now.Add(-30*time.Minute), 1)
+	if len(removed) != 2 || len(srv.Endpoints) != 1 || srv.Endpoints[0].Addr.Port != 2 {
+		t.Errorf("Unexpected pruned endpoints: %+v, kept %+v", removed, srv.Endpoints)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{PingTimeout: 50 * time.Millisecond}})
+	game := &master.EIGameInfo{ClientID: 1, Name: "Alpha", MaxPlayersCount: 8}
+	conn := startTestGame(t, srv, game, []byte{3, 0, 0, 0, 1})
+	waitForServers(t, srv, clock, 1)
+	// The same game from another address which doesn't answer pings.
+	sendGame(t, srv, game)
+
+	var servers []master.EIServerInfo
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		servers = getJSONList(t, srv)
+		if len(servers) == 1 && len(servers[0].Endpoints) == 2 && servers[0].Ping > 0 {
+			break
+		}
+	}
+	if len(servers) != 1 || len(servers[0].Endpoints) != 2 {
+		t.Fatalf("Unexpected servers: %+v", servers)
+	}
+	if servers[0].Addr.String() != conn.LocalAddr().String() || servers[0].Ping <= 0 {
+		t.Errorf("Answering endpoint isn't published: %+v", servers[0])
+	}
+}
@@ -0,0 +1,198 @@
+package masterserver
+
+import (
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Types of events published by the maintainer. A server is added when it
+// becomes visible to clients, updated when a visible server changes, hidden
+// when it's not updated for VisibleFor and removed when it's gone from the
+// registry. Snapshot is sent to subscribers only, it has the list of visible
+// servers.
+const (
+	EventAdd      = "add"
+	EventUpdate   = "update"
+	EventHide     = "hide"
+	EventRemove   = "remove"
+	EventSnapshot = "snapshot"
+)
+
+const (
+	eventHistorySize  = 1024 // Events kept to resume subscriptions
+	eventSubscriberCh = 256  // Events queued for a subscriber before it's dropped
+)
+
+// Event is a change of the servers list.
+type Event struct {
+	ID      uint64                `json:"id"`
+	Type    string                `json:"type"`
+	Time    time.Time             `json:"time"`
+	Server  *master.EIServerInfo  `json:"server,omitempty"`
+	Servers []master.EIServerInfo `json:"servers,omitempty"`
+}
+
+// eventBus delivers events to subscribers and keeps recent events, so that
+// subscribers may resume after reconnect.
+type eventBus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// eventSubscriber gets events from its channel. The channel is closed if the
+// subscriber falls behind, it should resubscribe then.
+type eventSubscriber struct {
+	events chan Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+func (bus *eventBus) publish(typ string, srv *master.EIServerInfo, now time.Time) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.lastID++
+	event := Event{ID: bus.lastID, Type: typ, Time: now, Server: srv.Copy()}
+	if len(bus.history) == eventHistorySize {
+		bus.history = append(bus.history[:0], bus.history[1:]...)
+	}
+	bus.history = append(bus.history, event)
+
+	for sub := range bus.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			delete(bus.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe returns the new subscriber and events published after lastID. If
+// some of them are not kept anymore, ok is false and lastID is the ID of the
+// last event, the subscriber needs the snapshot then.
+func (bus *eventBus) subscribe(lastID uint64, resume bool) (sub *eventSubscriber, missed []Event, id uint64, ok bool) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	sub = &eventSubscriber{events: make(chan Event, eventSubscriberCh)}
+	bus.subscribers[sub] = struct{}{}
+
+	if !resume || lastID > bus.lastID {
+		return sub, nil, bus.lastID, false
+	}
+	if lastID == bus.lastID {
+		return sub, nil, lastID, true
+	}
+	if len(bus.history) == 0 || bus.history[0].ID > lastID+1 {
+		return sub, nil, bus.lastID, false
+	}
+	for _, event := range bus.history {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, bus.lastID, true
+}
+
+func (bus *eventBus) unsubscribe(sub *eventSubscriber) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if _, ok := bus.subscribers[sub]; ok {
+		delete(bus.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (bus *eventBus) subscribersCount() int {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return len(bus.subscribers)
+}
+
+// visiblyChanged checks whether clients see a difference between the
+// published server and its new state. Times of updates and ping statistics
+// other than the rounded ping change all the time, they are published along
+// with visible changes only.
+func visiblyChanged(published, srv *master.EIServerInfo) bool {
+	return !equalStrings(published.PlayerNames, srv.PlayerNames) ||
+		!equalStrings(published.Tags, srv.Tags) ||
+		published.Pinned != srv.Pinned ||
+		published.Addr.String() != srv.Addr.String() ||
+		published.Name != srv.Name ||
+		published.Quest != srv.Quest ||
+		published.PlayersCount != srv.PlayersCount ||
+		published.MaxPlayersCount != srv.MaxPlayersCount ||
+		published.HasPassword != srv.HasPassword ||
+		published.AllodIndex != srv.AllodIndex ||
+		published.Ping != srv.Ping ||
+		published.TokenVerified != srv.TokenVerified ||
+		published.Origin != srv.Origin ||
+		published.Mirror != srv.Mirror
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// serverStored publishes the change of the stored server with its mark if
+// clients see it. It's called by the maintainer only.
+func (s *Server) serverStored(stored *master.EIServerInfo) {
+	if s.clock.Now().Sub(stored.LastUpdate) > s.Config().VisibleFor {
+		return
+	}
+	srv := stored.Copy()
+	s.moderation.applyTo(srv)
+	if published, shown := s.shown[srv.ID]; shown {
+		if visiblyChanged(published, srv) {
+			s.shown[srv.ID] = srv
+			s.events.publish(EventUpdate, srv, s.clock.Now())
+		}
+	} else {
+		s.shown[srv.ID] = srv
+		s.events.publish(EventAdd, srv, s.clock.Now())
+	}
+}
+
+// serverRemoved publishes removal of the server. It's called by the
+// maintainer only.
+func (s *Server) serverRemoved(removed *master.EIServerInfo) {
+	srv := removed.Copy()
+	s.moderation.applyTo(srv)
+	delete(s.shown, srv.ID)
+	s.forgetServerPings(srv.ID)
+	s.events.publish(EventRemove, srv, s.clock.Now())
+	if err := s.moderation.forget(srv.ID); err != nil {
+		s.log.Errorf("Failed to save moderation file: %s", err)
+	}
+}
+
+// hideInvisible publishes hiding of servers which are not visible anymore.
+// It's called by the maintainer only.
+func (s *Server) hideInvisible() {
+	visible := make(map[uint64]bool, len(s.shown))
+	for _, srv := range s.visibleServers() {
+		visible[srv.ID] = true
+	}
+	hidden := s.registry.List(func(srv *master.EIServerInfo) bool {
+		_, shown := s.shown[srv.ID]
+		return shown && !visible[srv.ID]
+	})
+	for i := range hidden {
+		s.moderation.applyTo(&hidden[i])
+		delete(s.shown, hidden[i].ID)
+		s.events.publish(EventHide, &hidden[i], s.clock.Now())
+	}
+}
@@ -0,0 +1,232 @@
+package masterserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestEventBusResume(t *testing.T) {
+	bus := newEventBus()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServerInfo(1, "First", now)
+	for i := 0; i < eventHistorySize+10; i++ {
+		bus.publish(EventUpdate, srv, now)
+	}
+
+	sub, missed, id, ok := bus.subscribe(eventHistorySize, true)
+	if !ok || len(missed) != 10 || missed[0].ID != eventHistorySize+1 || id != eventHistorySize+10 {
+		t.Errorf("Unexpected resume: %v %d %d", ok, len(missed), id)
+	}
+	bus.unsubscribe(sub)
+
+	// Events before the history need the snapshot
+	for _, lastID := range []uint64{1, eventHistorySize + 100} {
+		sub, missed, id, ok = bus.subscribe(lastID, true)
+		if ok || len(missed) != 0 || id != eventHistorySize+10 {
+			t.Errorf("Stream is resumed from %d: %d %d", lastID, len(missed), id)
+		}
+		bus.unsubscribe(sub)
+	}
+
+	// Slow subscriber is dropped
+	sub, _, _, _ = bus.subscribe(0, false)
+	for i := 0; i < eventSubscriberCh+1; i++ {
+		bus.publish(EventUpdate, srv, now)
+	}
+	if bus.subscribersCount() != 0 {
+		t.Errorf("Slow subscriber isn't dropped")
+	}
+	for range sub.events {
+	}
+}
+
+// readSSE reads the next event from the stream.
+func readSSE(t *testing.T, r *bufio.Reader) Event {
+	var event Event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(line[len("data: "):]), &event); err != nil {
+				t.Fatal(err)
+			}
+		} else if line == "\n" && event.Type != "" {
+			return event
+		}
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if event := readSSE(t, r); event.Type != EventSnapshot || len(event.Servers) != 0 {
+		t.Fatalf("Unexpected first event: %+v", event)
+	}
+
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayerNames: []string{}})
+	added := readSSE(t, r)
+	if added.Type != EventAdd || added.Server == nil || added.Server.Name != "Alpha" {
+		t.Fatalf("Unexpected event: %+v", added)
+	}
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute)
+	}
+	// The server may be updated by its ping result before it's hidden
+	event := readSSE(t, r)
+	for event.Type == EventUpdate {
+		event = readSSE(t, r)
+	}
+	if event.Type != EventHide || event.Server.ID != added.Server.ID {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	resp.Body.Close()
+
+	// Resumed stream has missed events only
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v1/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resumed := readSSE(t, bufio.NewReader(resp.Body)); resumed.ID != 2 {
+		t.Fatalf("Unexpected event after resume: %+v", resumed)
+	}
+}
+
+func TestEventsWebSocket(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /api/v1/events HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake: %s %v", resp.Status, resp.Header)
+	}
+
+	ws := &wsConn{conn: conn, r: r}
+	op, payload, err := ws.readFrame()
+	var event Event
+	if err != nil || op != wsOpText || json.Unmarshal(payload, &event) != nil || event.Type != EventSnapshot {
+		t.Fatalf("Unexpected first message: %v %d %s", err, op, payload)
+	}
+
+	// Masked close frame from the client is answered
+	mask := []byte{1, 2, 3, 4}
+	closePayload := make([]byte, 2)
+	binary.BigEndian.PutUint16(closePayload, wsCloseNormal)
+	frame := append([]byte{0x80 | wsOpClose, 0x80 | 2}, mask...)
+	for i, b := range closePayload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+	if op, _, err := ws.readFrame(); err != nil || op != wsOpClose {
+		t.Errorf("Close isn't answered: %v %d", err, op)
+	}
+}
+
+func TestEventsSkipInvisibleUpdates(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(Options{Clock: clock})
+	stored := newTestServerInfo(1, "Alpha", clock.Now())
+	stored.ID = 1
+	srv.serverStored(stored)
+
+	// Repeated announcements and ping results which don't change the ping
+	// aren't published.
+	stored.LastUpdate = clock.Now().Add(time.Second)
+	stored.LastSuccessfulPing = stored.LastUpdate
+	stored.PingStats.RTT = 0.3
+	stored.PingStats.Sent++
+	srv.serverStored(stored)
+	if events := srv.events.history; len(events) != 1 || events[0].Type != EventAdd {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+
+	stored.PlayersCount = 2
+	srv.serverStored(stored)
+	stored.LastUpdate = clock.Now().Add(2 * time.Second)
+	srv.serverStored(stored)
+	if events := srv.events.history; len(events) != 2 || events[1].Type != EventUpdate ||
+		events[1].Server.PlayersCount != 2 {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+}
+
+func TestEventsMarks(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, AdminToken: "secret"})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha"})
+	id := waitForServers(t, srv, clock, 1)[0].ID
+
+	sub, _, _, _ := srv.events.subscribe(0, false)
+	defer srv.events.unsubscribe(sub)
+	next := func() Event {
+		select {
+		case event := <-sub.events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event isn't published")
+			return Event{}
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/moderation/servers/"+strconv.FormatUint(id, 10),
+		strings.NewReader(`{"tags": ["official"], "pinned": 1}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to mark server: %d %s", w.Code, w.Body)
+	}
+	if event := next(); event.Type != EventUpdate || event.Server.Pinned != 1 || len(event.Server.Tags) != 1 {
+		t.Errorf("Unexpected event after mark: %+v", event)
+	}
+
+	// Updates of the server keep its mark
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayersCount: 2})
+	if event := next(); event.Type != EventUpdate || event.Server.Pinned != 1 || event.Server.PlayersCount != 2 {
+		t.Errorf("Unexpected event after update: %+v", event)
+	}
+}
@@ -0,0 +1,266 @@
+package masterserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Masters exchange their registries by polling each other over HTTP. A peer
+// returns the entries changed since the cursor got by previous request. The
+// cursor is valid only for the same epoch which is changed on every start of
+// the peer, in this case all entries are returned.
+//
+// Entries keep the name of the master they are registered on and the number
+// of hops. Masters never accept their own entries back and don't relay
+// entries which have reached the hop limit. Copies of the same entry got from
+// different peers are merged by the last writer wins rule on LastUpdate.
+
+// peerDelta is the response of the peer sync endpoint.
+type peerDelta struct {
+	Master  string                `json:"master"`
+	Epoch   string                `json:"epoch"`
+	Cursor  uint64                `json:"cursor"`
+	Servers []master.EIServerInfo `json:"servers"`
+}
+
+// changeLog numbers changes of registry entries to find deltas.
+type changeLog struct {
+	mu    sync.Mutex
+	epoch string
+	seq   uint64
+	seqs  map[uint64]uint64 // Entry ID -> seq of the last change
+}
+
+func newChangeLog() *changeLog {
+	var epoch [8]byte
+	rand.Read(epoch[:])
+	return &changeLog{epoch: hex.EncodeToString(epoch[:]), seqs: make(map[uint64]uint64)}
+}
+
+func (c *changeLog) touch(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.seqs[id] = c.seq
+}
+
+// changedSince returns the current cursor and a filter of entries changed
+// since the cursor. Entries unchanged since start are changed since zero.
+func (c *changeLog) changedSince(cursor uint64) (uint64, func(id uint64) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seqs := make(map[uint64]uint64, len(c.seqs))
+	for id, seq := range c.seqs {
+		seqs[id] = seq
+	}
+	return c.seq, func(id uint64) bool {
+		return cursor == 0 || seqs[id] > cursor
+	}
+}
+
+// retain forgets changes of entries which aren't in the registry anymore.
+func (c *changeLog) retain(servers []master.EIServerInfo) {
+	ids := make(map[uint64]bool, len(servers))
+	for i := range servers {
+		ids[servers[i].ID] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.seqs {
+		if !ids[id] {
+			delete(c.seqs, id)
+		}
+	}
+}
+
+type peerState struct {
+	epoch  string
+	cursor uint64
+}
+
+// peerOnly serves handler only if the peer token is set, it's checked by the
+// handler.
+func (s *Server) peerOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.opts.PeerToken == "" {
+			http.Error(w, "peer token is not set", http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// servePeerDelta serves entries changed since the cursor of the requesting peer.
+func (s *Server) servePeerDelta(w http.ResponseWriter, req *http.Request) {
+	if s.opts.PeerToken != "" && !hasToken(req, s.opts.PeerToken) {
+		http.Error(w, "invalid peer token", http.StatusUnauthorized)
+		return
+	}
+	query := req.URL.Query()
+	peerName := query.Get("peer")
+	var since uint64
+	if query.Get("epoch") == s.changes.epoch {
+		since, _ = strconv.ParseUint(query.Get("since"), 10, 64)
+	}
+
+	maxHops := s.Config().PeerMaxHops
+	cursor, changed := s.changes.changedSince(since)
+	delta := peerDelta{Master: s.opts.PeerName, Epoch: s.changes.epoch, Cursor: cursor}
+	delta.Servers = s.registry.List(func(srv *master.EIServerInfo) bool {
+		return changed(srv.ID) && srv.Mirror == "" && srv.Origin != peerName &&
+			(maxHops < 0 || srv.Hops < maxHops)
+	})
+	for i := range delta.Servers {
+		srv := &delta.Servers[i]
+		if srv.Origin == "" {
+			srv.Origin, srv.OriginID = s.opts.PeerName, srv.ID
+		}
+		srv.ID = 0
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&delta); err != nil {
+		s.log.Errorf("Failed to send delta to peer %q: %s", peerName, err)
+	}
+}
+
+// fetchPeerDelta requests entries changed since the previous request.
+func (s *Server) fetchPeerDelta(ctx context.Context, peer string, state *peerState) (*peerDelta, error) {
+	query := url.Values{}
+	query.Set("peer", s.opts.PeerName)
+	query.Set("epoch", state.epoch)
+	query.Set("since", strconv.FormatUint(state.cursor, 10))
+	reqURL := strings.TrimSuffix(peer, "/") + "/peer/delta?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.PeerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.PeerToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var delta peerDelta
+	if err := json.NewDecoder(resp.Body).Decode(&delta); err != nil {
+		return nil, fmt.Errorf("invalid delta: %w", err)
+	}
+	state.epoch, state.cursor = delta.Epoch, delta.Cursor
+	return &delta, nil
+}
+
+// syncPeers polls the peers every time the maintainer asks for it.
+func (s *Server) syncPeers(ctx context.Context) error {
+	states := make(map[string]*peerState, len(s.opts.Peers))
+	for _, peer := range s.opts.Peers {
+		states[peer] = &peerState{}
+	}
+
+	for {
+		select {
+		case <-s.peerSync:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		for _, peer := range s.opts.Peers {
+			reqCtx, cancel := context.WithTimeout(ctx, s.Config().PeerSyncInterval)
+			delta, err := s.fetchPeerDelta(reqCtx, peer, states[peer])
+			cancel()
+			if err != nil {
+				s.metrics.peerSyncs.Inc("error")
+				s.log.Warnf("Failed to sync with peer %s: %s", peer, err)
+				continue
+			}
+			s.metrics.peerSyncs.Inc("success")
+			s.log.Debugf("Got %d servers from peer %s (%q)", len(delta.Servers), peer, delta.Master)
+			if len(delta.Servers) == 0 {
+				continue
+			}
+			select {
+			case s.remoteUpdates <- delta.Servers:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// mergeRemote stores entries got from other masters. It's called by the
+// maintainer only.
+func (s *Server) mergeRemote(servers []master.EIServerInfo, cfg *Config) {
+	for i := range servers {
+		remote := &servers[i]
+		if remote.Origin == "" || remote.Origin == s.opts.PeerName {
+			continue // Our own entry has returned
+		}
+		if !s.applyPolicy(remote) || s.banned(remote) {
+			continue
+		}
+		remote.Hops++
+		remote.ID = 0
+		remote.TokenVerified = false
+
+		var existing, local, mirrored *master.EIServerInfo
+		matches := s.registry.List(func(srv *master.EIServerInfo) bool {
+			return srv.Origin == remote.Origin && srv.OriginID == remote.OriginID ||
+				srv.Origin == "" && srv.Addr.String() == remote.Addr.String()
+		})
+		for j := range matches {
+			switch {
+			case matches[j].Mirror != "":
+				mirrored = &matches[j]
+			case matches[j].Origin == "":
+				local = &matches[j]
+			default:
+				existing = &matches[j]
+			}
+		}
+		if local != nil {
+			// The game server is registered here too, local entry wins.
+			continue
+		}
+		if existing != nil {
+			if !remote.LastUpdate.After(existing.LastUpdate) {
+				continue
+			}
+			remote.ID = existing.ID
+			remote.Ping = existing.Ping
+			remote.PingStats = existing.PingStats
+			remote.LastSuccessfulPing = existing.LastSuccessfulPing
+		} else if mirrored != nil {
+			// Peers know the game server first hand, their entry replaces the copy.
+			remote.ID = mirrored.ID
+		} else if reason := s.checkCopyQuota(cfg); reason != "" {
+			s.metrics.serversRejected.Inc(reason)
+			s.log.Warnf("Remote server %s from %q is rejected: %s", remote, remote.Origin, reason)
+			continue
+		}
+
+		storedSrv, err := s.registry.Upsert(remote)
+		if err != nil {
+			s.log.Errorf("Failed to store remote server %s: %s", remote, err)
+			continue
+		}
+		s.changes.touch(storedSrv.ID)
+		s.serverStored(storedSrv)
+		s.metrics.remoteUpdates.Inc(storedSrv.Origin)
+	}
+}
@@ -0,0 +1,70 @@
+package masterserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestFederation(t *testing.T) {
+	// Handlers are set after the servers are started, but before any sync
+	var handlerA, handlerB http.Handler
+	tsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlerA.ServeHTTP(w, req)
+	}))
+	defer tsA.Close()
+	tsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlerB.ServeHTTP(w, req)
+	}))
+	defer tsB.Close()
+
+	clockA, clockB := newFakeClock(), newFakeClock()
+	srvA := startTestServer(t, Options{Clock: clockA, PeerName: "a", Peers: []string{tsB.URL}, PeerToken: "secret"})
+	srvB := startTestServer(t, Options{Clock: clockB, PeerName: "b", Peers: []string{tsA.URL}, PeerToken: "secret"})
+	handlerA, handlerB = srvA.Handler(), srvB.Handler()
+
+	game := &master.EIGameInfo{ClientID: 1, Name: "Remote", PlayerNames: []string{}}
+	sendGame(t, srvA, game)
+	waitForServers(t, srvA, clockA, 1)
+	servers := waitForServers(t, srvB, clockB, 1)
+	if servers[0].Name != "Remote" || servers[0].Origin != "a" || servers[0].Hops != 1 {
+		t.Errorf("Unexpected remote server: %+v", servers[0])
+	}
+	if servers := getTCPList(t, srvB); len(servers) != 1 || servers[0].Name != "Remote" {
+		t.Errorf("Remote server isn't sent over TCP: %+v", servers)
+	}
+
+	// The entry doesn't come back to its origin
+	for i := 0; i < 15; i++ {
+		clockA.Advance(time.Second)
+	}
+	if servers := getJSONList(t, srvA); len(servers) != 1 || servers[0].Origin != "" {
+		t.Errorf("Entry has come back to origin: %+v", servers)
+	}
+
+	// Newer updates replace older ones
+	game.PlayersCount = 5
+	sendGame(t, srvA, game)
+	for i := 0; i < 100; i++ {
+		clockA.Advance(time.Second)
+		clockB.Advance(time.Second)
+		servers = getJSONList(t, srvB)
+		if len(servers) == 1 && servers[0].PlayersCount == 5 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Update hasn't reached peer: %+v", servers)
+}
+
+func TestPeerToken(t *testing.T) {
+	srv := startTestServer(t, Options{PeerToken: "secret"})
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/peer/delta", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Delta is served without token: %d", w.Code)
+	}
+}
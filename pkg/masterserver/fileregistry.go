@@ -0,0 +1,221 @@
+package masterserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// FileRegistry is a Registry which persists another registry to a file. Every
+// change is appended to a journal next to the state file and the whole registry
+// is written to the state file by SaveSnapshot. On open the state file is
+// loaded and the journal is replayed on top of it, so only changes made after
+// the last journal write are lost if the process crashes. Journal writes aren't
+// synced, unlike snapshots, so a crash of the OS or power loss may also lose
+// changes since the last snapshot. FileRegistry assigns IDs itself and persists
+// the last one, so IDs are never reused across restarts.
+type FileRegistry struct {
+	Registry
+	mu      sync.Mutex
+	path    string
+	journal *os.File
+	extras  map[string][]byte
+	lastID  uint64
+}
+
+// NewFileRegistry opens an in-memory registry persisted to the file at path.
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	return OpenFileRegistry(path, NewMemoryRegistry())
+}
+
+// OpenFileRegistry loads the state from path into reg and returns the registry
+// persisting reg to path. State files of older formats are migrated.
+func OpenFileRegistry(path string, reg Registry) (*FileRegistry, error) {
+	state, version, err := loadState(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state %s: %w", path, err)
+	}
+	lastID := state.LastID
+	for i := range state.Servers {
+		if _, err := reg.Upsert(&state.Servers[i]); err != nil {
+			return nil, err
+		}
+		if state.Servers[i].ID > lastID {
+			lastID = state.Servers[i].ID
+		}
+	}
+
+	journal, err := os.OpenFile(path+".journal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journalID, err := replayJournal(journal, reg)
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay journal of %s: %w", path, err)
+	}
+	if journalID > lastID {
+		lastID = journalID
+	}
+
+	fileReg := &FileRegistry{Registry: reg, path: path, journal: journal, extras: state.Extras, lastID: lastID}
+	if fileReg.extras == nil {
+		fileReg.extras = make(map[string][]byte)
+	}
+	if version < stateVersion {
+		// Migrate the state to the current format right away.
+		if err := fileReg.SaveSnapshot(); err != nil {
+			journal.Close()
+			return nil, fmt.Errorf("failed to migrate state %s: %w", path, err)
+		}
+	}
+	return fileReg, nil
+}
+
+// replayJournal applies journal records to reg. The journal is truncated after
+// the last valid record, the rest is probably a write interrupted by crash.
+// Replaying is idempotent, so it doesn't matter if the records are already in
+// the state file. The greatest ID of upserted entries is returned.
+func replayJournal(journal *os.File, reg Registry) (uint64, error) {
+	r := bufio.NewReader(journal)
+	var offset int64
+	var lastID uint64
+	for {
+		var rec journalRecord
+		n, err := readJournalRecord(r, &rec)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if errors.Is(err, errCorruptedJournal) {
+			if err := journal.Truncate(offset); err != nil {
+				return 0, err
+			}
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		offset += int64(n)
+
+		switch rec.Op {
+		case journalUpsert:
+			_, err = reg.Upsert(&rec.Server)
+			if rec.Server.ID > lastID {
+				lastID = rec.Server.ID
+			}
+		case journalExpire:
+			_, err = reg.Expire(rec.Before)
+		case journalRemove:
+			_, err = reg.Remove(rec.ID)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := journal.Seek(offset, io.SeekStart)
+	return lastID, err
+}
+
+// Upsert, Remove and Expire write the journal record first and change the
+// registry only if the record is written, so a failed change is neither listed
+// nor restored on restart.
+
+func (reg *FileRegistry) Upsert(srv *master.EIServerInfo) (*master.EIServerInfo, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	srv = srv.Copy()
+	if srv.ID == 0 {
+		srv.ID = reg.lastID + 1
+	}
+	if err := writeJournalRecord(reg.journal, &journalRecord{Op: journalUpsert, Server: *srv}); err != nil {
+		return nil, err
+	}
+	srv, err := reg.Registry.Upsert(srv)
+	if err != nil {
+		return nil, err
+	}
+	if srv.ID > reg.lastID {
+		reg.lastID = srv.ID
+	}
+	return srv, nil
+}
+
+func (reg *FileRegistry) Remove(id uint64) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.Registry.Find(&master.EIServerInfo{ID: id}) == nil {
+		return false, nil
+	}
+	if err := writeJournalRecord(reg.journal, &journalRecord{Op: journalRemove, ID: id}); err != nil {
+		return false, err
+	}
+	return reg.Registry.Remove(id)
+}
+
+func (reg *FileRegistry) Expire(before time.Time) ([]master.EIServerInfo, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	expiring := reg.Registry.List(func(srv *master.EIServerInfo) bool {
+		return srv.LastUpdate.Before(before)
+	})
+	if len(expiring) == 0 {
+		return nil, nil
+	}
+	if err := writeJournalRecord(reg.journal, &journalRecord{Op: journalExpire, Before: before}); err != nil {
+		return nil, err
+	}
+	return reg.Registry.Expire(before)
+}
+
+// SaveSnapshot atomically writes all entries to the state file and clears the
+// journal.
+func (reg *FileRegistry) SaveSnapshot() error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	state := stateV2{Servers: reg.Registry.Snapshot(), Extras: reg.extras, LastID: reg.lastID}
+	if err := saveState(reg.path, &state); err != nil {
+		return err
+	}
+	if err := reg.journal.Truncate(0); err != nil {
+		return err
+	}
+	_, err := reg.journal.Seek(0, io.SeekStart)
+	return err
+}
+
+// LastID returns the greatest ID assigned by the registry, including IDs of
+// removed entries.
+func (reg *FileRegistry) LastID() uint64 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.lastID
+}
+
+// StateExtra returns the extra section of the state loaded from the file or
+// set by SetStateExtra. Nil is returned if there is no such section.
+func (reg *FileRegistry) StateExtra(name string) []byte {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.extras[name]
+}
+
+// SetStateExtra sets the extra section of the state. Extras are not
+// journaled, they are written by the next SaveSnapshot.
+func (reg *FileRegistry) SetStateExtra(name string, data []byte) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.extras[name] = data
+}
+
+// Close saves the snapshot and closes the journal.
+func (reg *FileRegistry) Close() error {
+	err := reg.SaveSnapshot()
+	if err2 := reg.journal.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
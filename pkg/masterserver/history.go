@@ -0,0 +1,230 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// The maintainer samples player counts on every refresh. Every sample is
+// added to the bucket of each tier, so tiers are downsampled independently.
+// Buckets older than the tier retention are dropped. Global series has a point
+// for every bucket with samples, server series have points only for buckets
+// in which the server was visible.
+
+// History file starts with historyMagic followed by GOB encoded historyData.
+const historyMagic = "EIHIST\x00\x01"
+
+// HistoryTier is a resolution of stored series.
+type HistoryTier struct {
+	Name string        // Resolution name used by API, e.g. "1m"
+	Step time.Duration // Bucket size
+	Keep time.Duration // Retention
+}
+
+// DefaultHistoryTiers keep minutes for a day and hours for a year.
+var DefaultHistoryTiers = []HistoryTier{
+	{Name: "1m", Step: time.Minute, Keep: 24 * time.Hour},
+	{Name: "1h", Step: time.Hour, Keep: 365 * 24 * time.Hour},
+}
+
+// historyPoint aggregates the samples of a bucket.
+type historyPoint struct {
+	Time       int64  // Unix time of the bucket start
+	Samples    uint32 // Number of samples, i.e. refreshes while the server was visible
+	Reachable  uint32 // Number of samples while the server answered pings
+	Players    uint32 // Sum of player counts of the samples
+	MaxPlayers uint32
+	Servers    uint32 // Sum of visible server counts, for global series only
+}
+
+// historySeries has points of every tier.
+type historySeries struct {
+	Points [][]historyPoint
+}
+
+type historyData struct {
+	Tiers   []string                  // Names of tiers the points are stored for
+	Global  *historySeries            // All servers
+	Servers map[uint64]*historySeries // Servers by ID
+}
+
+type history struct {
+	mu    sync.RWMutex
+	tiers []HistoryTier
+	data  historyData
+}
+
+func newHistory(tiers []HistoryTier) *history {
+	h := &history{tiers: tiers}
+	h.data = historyData{Global: h.newSeries(), Servers: make(map[uint64]*historySeries)}
+	for _, tier := range tiers {
+		h.data.Tiers = append(h.data.Tiers, tier.Name)
+	}
+	return h
+}
+
+func (h *history) newSeries() *historySeries {
+	return &historySeries{Points: make([][]historyPoint, len(h.tiers))}
+}
+
+// tier returns the index of the tier by name or -1.
+func (h *history) tier(name string) int {
+	for i, tier := range h.tiers {
+		if tier.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// add adds the sample to the last point of every tier.
+func (series *historySeries) add(tiers []HistoryTier, now time.Time, sample historyPoint) {
+	for i, tier := range tiers {
+		bucket := now.Truncate(tier.Step).Unix()
+		points := series.Points[i]
+		if len(points) == 0 || points[len(points)-1].Time != bucket {
+			points = append(points, historyPoint{Time: bucket})
+		}
+		p := &points[len(points)-1]
+		p.Samples += sample.Samples
+		p.Reachable += sample.Reachable
+		p.Players += sample.Players
+		p.Servers += sample.Servers
+		if sample.MaxPlayers > p.MaxPlayers {
+			p.MaxPlayers = sample.MaxPlayers
+		}
+		series.Points[i] = points
+	}
+}
+
+// trim drops points older than retention and returns false if nothing is left.
+func (series *historySeries) trim(tiers []HistoryTier, now time.Time) bool {
+	empty := true
+	for i, tier := range tiers {
+		since := now.Add(-tier.Keep).Unix()
+		points := series.Points[i]
+		n := 0
+		for n < len(points) && points[n].Time < since {
+			n++
+		}
+		series.Points[i] = append(points[:0], points[n:]...)
+		if len(series.Points[i]) > 0 {
+			empty = false
+		}
+	}
+	return !empty
+}
+
+// sample adds player counts of visible servers. Servers which answered pings
+// within reachableFor are counted as reachable.
+func (h *history) sample(now time.Time, servers []master.EIServerInfo, reachableFor time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := historyPoint{Samples: 1, Servers: uint32(len(servers))}
+	for i := range servers {
+		srv := &servers[i]
+		players := uint32(srv.PlayersCount)
+		point := historyPoint{Samples: 1, Players: players, MaxPlayers: players}
+		if now.Sub(srv.LastSuccessfulPing) <= reachableFor {
+			point.Reachable = 1
+		}
+		series, ok := h.data.Servers[srv.ID]
+		if !ok {
+			series = h.newSeries()
+			h.data.Servers[srv.ID] = series
+		}
+		series.add(h.tiers, now, point)
+		total.Players += point.Players
+		total.Reachable += point.Reachable
+	}
+	total.MaxPlayers = total.Players
+	h.data.Global.add(h.tiers, now, total)
+
+	h.data.Global.trim(h.tiers, now)
+	for id, series := range h.data.Servers {
+		if !series.trim(h.tiers, now) {
+			delete(h.data.Servers, id)
+		}
+	}
+}
+
+// points returns the points of the tier within [from, to). Zero times mean
+// no limit. Server ID 0 means the global series. Nil is returned if there is
+// no such series.
+func (h *history) points(id uint64, tier int, from, to time.Time) []historyPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	series := h.data.Global
+	if id != 0 {
+		series = h.data.Servers[id]
+	}
+	if series == nil {
+		return nil
+	}
+	var result []historyPoint
+	for _, p := range series.Points[tier] {
+		if (from.IsZero() || p.Time >= from.Unix()) && (to.IsZero() || p.Time < to.Unix()) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func (h *history) save(path string) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, historyMagic); err != nil {
+			return err
+		}
+		return gob.NewEncoder(w).Encode(&h.data)
+	})
+}
+
+// load reads the history saved by save. Missing file is not an error. Series
+// of tiers which aren't configured anymore are dropped.
+func (h *history) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(historyMagic)) {
+		return errors.New("not a history file")
+	}
+	var loaded historyData
+	if err := gob.NewDecoder(bytes.NewReader(data[len(historyMagic):])).Decode(&loaded); err != nil {
+		return fmt.Errorf("failed to decode history: %w", err)
+	}
+
+	convert := func(series *historySeries) *historySeries {
+		result := h.newSeries()
+		if series == nil {
+			return result
+		}
+		for i, name := range loaded.Tiers {
+			if tier := h.tier(name); tier >= 0 && i < len(series.Points) {
+				result.Points[tier] = series.Points[i]
+			}
+		}
+		return result
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data.Global = convert(loaded.Global)
+	h.data.Servers = make(map[uint64]*historySeries, len(loaded.Servers))
+	for id, series := range loaded.Servers {
+		h.data.Servers[id] = convert(series)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package masterserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestHistorySeries(t *testing.T) {
+	h := newHistory(DefaultHistoryTiers)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServerInfo(1, "First", start)
+	srv.ID = 1
+	for i := 0; i < 8; i++ {
+		now := start.Add(time.Duration(i) * 15 * time.Second)
+		srv.PlayersCount = uint8(i)
+		srv.LastSuccessfulPing = now
+		h.sample(now, []master.EIServerInfo{*srv}, time.Minute)
+	}
+
+	minutes := h.points(1, 0, time.Time{}, time.Time{})
+	if len(minutes) != 2 || minutes[0].Samples != 4 || minutes[0].Players != 0+1+2+3 ||
+		minutes[0].MaxPlayers != 3 || minutes[1].Reachable != 4 {
+		t.Errorf("Unexpected minute points: %+v", minutes)
+	}
+	hours := h.points(0, 1, time.Time{}, time.Time{})
+	if len(hours) != 1 || hours[0].Samples != 8 || hours[0].Servers != 8 || hours[0].MaxPlayers != 7 {
+		t.Errorf("Unexpected hour points: %+v", hours)
+	}
+
+	// Minute points are dropped after a day, the server is kept by hour points.
+	h.sample(start.Add(25*time.Hour), nil, time.Minute)
+	if points := h.points(1, 0, time.Time{}, time.Time{}); len(points) != 0 {
+		t.Errorf("Old points aren't dropped: %+v", points)
+	}
+	if points := h.points(1, 1, time.Time{}, time.Time{}); len(points) != 1 {
+		t.Errorf("Hour points are dropped: %+v", points)
+	}
+
+	path := filepath.Join(t.TempDir(), "history")
+	if err := h.save(path); err != nil {
+		t.Fatal(err)
+	}
+	// Tiers are matched by name on load
+	loaded := newHistory([]HistoryTier{DefaultHistoryTiers[1]})
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if points := loaded.points(1, 0, time.Time{}, time.Time{}); len(points) != 1 || points[0].Samples != 8 {
+		t.Errorf("Unexpected loaded points: %+v", points)
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayersCount: 2, PlayerNames: []string{}})
+	servers := waitForServers(t, srv, clock, 1)
+	// Sample hidden server, so it's not available for some time.
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Minute)
+	}
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET",
+		fmt.Sprintf("/api/v1/servers/%d/history?resolution=1h", servers[0].ID), nil))
+	var resp apiHistory
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Points) != 1 || resp.Points[0].PlayersAvg != 2 || resp.Availability == nil ||
+		*resp.Availability <= 0 || *resp.Availability >= 100 || resp.Uptime == nil {
+		t.Errorf("Unexpected server history: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/history", nil))
+	resp = apiHistory{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Points) == 0 {
+		t.Errorf("Unexpected global history: %s", w.Body)
+	}
+
+	for _, url := range []string{"/api/v1/history?resolution=1d", "/api/v1/history?from=yesterday"} {
+		w = httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 400 {
+			t.Errorf("Unexpected status of %s: %d", url, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/servers/100/history", nil))
+	if w.Code != 404 {
+		t.Errorf("History of unknown server is found: %d", w.Code)
+	}
+}
+
+func TestHistoryRequiresPersistentIDs(t *testing.T) {
+	// IDs of the memory registry restart from 1, so saved history would be
+	// inherited by other servers.
+	srv := New(Options{Addr: "127.0.0.1:0", HistoryPath: filepath.Join(t.TempDir(), "history")})
+	if err := srv.Start(context.Background()); err == nil {
+		srv.Shutdown(context.Background())
+		t.Fatal("Server with history and memory registry is started")
+	}
+}
@@ -0,0 +1,63 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+)
+
+// Handler returns the HTTP handler serving the list of visible servers as JSON,
+// REST API under api/v1, see api.go, and the server browser page. It allows to
+// mount the master server API into another HTTP server. Admin endpoints are
+// served under the prefix too unless admin listener is set, then they require
+// the admin token or, for peers, the peer token.
+func (s *Server) Handler() http.Handler {
+	handler := http.NewServeMux()
+	handler.HandleFunc(s.opts.HTTPPrefix, s.metrics.countRequests("servers", s.serveServersJSON))
+	s.handleAPI(handler, s.opts.HTTPPrefix)
+	handler.HandleFunc(path.Join(s.opts.HTTPPrefix, "browser"),
+		s.metrics.countRequests("browser", s.serveBrowser))
+	if s.opts.AdminAddr == "" && s.opts.AdminListener == nil {
+		s.handleAdmin(handler, s.opts.HTTPPrefix, true)
+	}
+	return handler
+}
+
+// AdminHandler returns the HTTP handler serving admin endpoints.
+func (s *Server) AdminHandler() http.Handler {
+	handler := http.NewServeMux()
+	s.handleAdmin(handler, "/", false)
+	return handler
+}
+
+// handleAdmin adds admin endpoints. Public endpoints are protected by tokens,
+// moderation requires the admin token anyway.
+func (s *Server) handleAdmin(handler *http.ServeMux, prefix string, public bool) {
+	adminOnly := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	peerOnly := adminOnly
+	if public {
+		adminOnly, peerOnly = s.adminOnly, s.peerOnly
+	}
+	handler.HandleFunc(path.Join(prefix, "metrics"), adminOnly(s.metrics.serveHTTP))
+	handler.HandleFunc(path.Join(prefix, "peer/delta"),
+		s.metrics.countRequests("peer_delta", peerOnly(s.servePeerDelta)))
+	handler.HandleFunc(path.Join(prefix, "pings")+"/",
+		s.metrics.countRequests("ping_reply", adminOnly(s.servePingReply)))
+	s.handleModeration(handler, prefix)
+}
+
+func (s *Server) serveServersJSON(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(s.visibleServers())
+	if err != nil {
+		s.log.Errorf("Failed to convert server list to JSON: %s", err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write((data))
+	if err != nil {
+		s.log.Errorf("Failed write HTTP response: %s", err)
+		return
+	}
+}
@@ -0,0 +1,181 @@
+package masterserver
+
+import (
+	"context"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// snapshotter is implemented by registries which are able to persist their
+// entries, see FileRegistry.
+type snapshotter interface {
+	SaveSnapshot() error
+}
+
+// idKeeper is implemented by registries which never reuse IDs, even after
+// restart, see FileRegistry. History and marks of moderators are keyed by IDs,
+// so they are kept across restarts only with such registries.
+type idKeeper interface {
+	LastID() uint64
+}
+
+// visibleServers returns servers which should be sent to clients.
+func (s *Server) visibleServers() []master.EIServerInfo {
+	curTime, visibleFor := s.clock.Now(), s.Config().VisibleFor
+	servers := s.registry.List(func(srv *master.EIServerInfo) bool {
+		return curTime.Sub(srv.LastUpdate) <= visibleFor
+	})
+	s.moderation.apply(servers)
+	return servers
+}
+
+func (s *Server) maintainServerList(ctx context.Context) error {
+	cfg := s.Config()
+	ticker := s.clock.NewTicker(cfg.RefreshInterval)
+	defer func() { ticker.Stop() }()
+
+	lastSnapshot := s.clock.Now()
+	var lastPeerSync, lastMirrorSync time.Time
+
+	for {
+		select {
+		case <-s.cfgChanged:
+			newCfg := s.Config()
+			if newCfg.RefreshInterval != cfg.RefreshInterval {
+				ticker.Stop()
+				ticker = s.clock.NewTicker(newCfg.RefreshInterval)
+			}
+			cfg = newCfg
+			s.log.Infof("Config is applied: %+v", cfg)
+
+		case <-ticker.C():
+			expired, err := s.registry.Expire(s.clock.Now().Add(-cfg.ExpireAfter))
+			if err != nil {
+				s.log.Errorf("Failed to remove expired servers: %s", err)
+			}
+			for i := range expired {
+				s.log.Debugf("Server %s hasn't sent updates for %s, removing...",
+					&expired[i], cfg.ExpireAfter)
+				s.serverRemoved(&expired[i])
+			}
+			for _, result := range s.schedulePings(&cfg) {
+				s.applyPingResult(&result)
+			}
+			s.challenges.cleanup(s.clock.Now().Add(-cfg.VisibleFor))
+			if cfg.PacketRate > 0 {
+				s.limiter.cleanup(s.clock.Now(), cfg.PacketRate, cfg.PacketBurst)
+			}
+			s.log.Debugf("Servers list were refreshed: running: %d, visible: %d...",
+				len(s.registry.Snapshot()), len(s.visibleServers()))
+
+			s.changes.retain(s.registry.Snapshot())
+			if len(s.opts.Peers) > 0 && s.clock.Now().Sub(lastPeerSync) >= cfg.PeerSyncInterval {
+				select {
+				case s.peerSync <- struct{}{}:
+				default:
+				}
+				lastPeerSync = s.clock.Now()
+			}
+			s.expireMirrored(&cfg)
+			s.hideInvisible()
+			if len(s.opts.Mirrors) > 0 && s.clock.Now().Sub(lastMirrorSync) >= cfg.MirrorInterval {
+				select {
+				case s.mirrorSync <- struct{}{}:
+				default:
+				}
+				lastMirrorSync = s.clock.Now()
+			}
+
+			visible := s.visibleServers()
+			s.history.sample(s.clock.Now(), visible, cfg.VisibleFor)
+			s.players.update(s.clock.Now(), visible)
+
+			if s.clock.Now().Sub(lastSnapshot) >= cfg.SnapshotInterval {
+				s.storePlayers()
+				if snap, ok := s.registry.(snapshotter); ok {
+					if err := snap.SaveSnapshot(); err != nil {
+						s.log.Errorf("Failed to save state: %s", err)
+					}
+				}
+				s.saveHistory()
+				lastSnapshot = s.clock.Now()
+			}
+
+		case updSrv := <-s.updates:
+			existingSrv := s.findExisting(updSrv, &cfg)
+			if existingSrv == nil {
+				if reason := s.checkQuotas(updSrv, &cfg); reason != "" {
+					s.metrics.serversRejected.Inc(reason)
+					s.log.Warnf("Server %s is rejected: %s", updSrv, reason)
+					break
+				}
+				s.log.Debugf("Received new server: %s", updSrv)
+			} else {
+				s.log.Debugf("Received update for existing server: %s", updSrv)
+				// Reuse some parameters from existing server
+				updSrv.ID = existingSrv.ID
+				updSrv.AppearTime = existingSrv.AppearTime
+				updSrv.Endpoints = endpointsOf(existingSrv)
+				if updSrv.IsSentByOrigGame() {
+					updSrv.PlayerNames = existingSrv.PlayerNames
+				}
+			}
+			// The update came from updSrv.Addr, the published address is
+			// chosen among all endpoints.
+			seeEndpoint(updSrv, updSrv.Addr, s.clock.Now())
+			for _, endpoint := range pruneEndpoints(updSrv, s.clock.Now().Add(-cfg.ExpireAfter), cfg.MaxEndpoints) {
+				s.forgetPing(&endpoint.Addr)
+			}
+			selectEndpoint(updSrv, s.clock.Now().Add(-cfg.VisibleFor))
+			storedSrv, err := s.registry.Upsert(updSrv)
+			if err != nil {
+				s.log.Errorf("Failed to store server %s: %s", updSrv, err)
+				break
+			}
+			s.changes.touch(storedSrv.ID)
+			s.serverStored(storedSrv)
+			var lost []pingResult
+			for _, endpoint := range storedSrv.Endpoints {
+				if result, ok := s.watchPing(storedSrv.ID, endpoint.Addr, &cfg); !ok {
+					lost = append(lost, result)
+				}
+			}
+			for _, result := range lost {
+				s.applyPingResult(&result)
+			}
+
+		case servers := <-s.remoteUpdates:
+			s.mergeRemote(servers, &cfg)
+
+		case list := <-s.mirrorUpdates:
+			s.mergeMirrored(list, &cfg)
+
+		case r := <-s.removals:
+			s.remove(r)
+
+		case id := <-s.markChanges:
+			if srv := s.registry.Find(&master.EIServerInfo{ID: id}); srv != nil {
+				s.serverStored(srv)
+			}
+
+		case result := <-s.pingResults:
+			s.applyPingResult(&result)
+
+		case <-ctx.Done():
+			s.saveHistory()
+			// The registry saves players with the last snapshot when it's closed.
+			s.storePlayers()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) saveHistory() {
+	if s.opts.HistoryPath == "" {
+		return
+	}
+	if err := s.history.save(s.opts.HistoryPath); err != nil {
+		s.log.Errorf("Failed to save history: %s", err)
+	}
+}
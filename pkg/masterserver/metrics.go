@@ -0,0 +1,334 @@
+package masterserver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// This is a minimal implementation of Prometheus text exposition format. It
+// supports only the metric types the server needs.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (reg *metricsRegistry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+func (reg *metricsRegistry) write(w io.Writer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, m := range reg.metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+type counter struct {
+	name, help string
+	val        uint64
+}
+
+func (reg *metricsRegistry) counter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	reg.register(c)
+	return c
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.val, 1)
+}
+
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.val)
+}
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// counterVec is a set of counters distinguished by the value of one label.
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	vals              map[string]*uint64
+}
+
+func (reg *metricsRegistry) counterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, vals: make(map[string]*uint64)}
+	reg.register(c)
+	return c
+}
+
+func (c *counterVec) Inc(labelVal string) {
+	c.mu.Lock()
+	val, ok := c.vals[labelVal]
+	if !ok {
+		val = new(uint64)
+		c.vals[labelVal] = val
+	}
+	c.mu.Unlock()
+	atomic.AddUint64(val, 1)
+}
+
+func (c *counterVec) Value(labelVal string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if val, ok := c.vals[labelVal]; ok {
+		return atomic.LoadUint64(val)
+	}
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	labelVals := make([]string, 0, len(c.vals))
+	for labelVal := range c.vals {
+		labelVals = append(labelVals, labelVal)
+	}
+	sort.Strings(labelVals)
+	for _, labelVal := range labelVals {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n",
+			c.name, c.label, escapeLabel(labelVal), atomic.LoadUint64(c.vals[labelVal]))
+	}
+}
+
+// gaugeFunc is a gauge which values are computed on every scrape. The values
+// are distinguished by the value of label. If label is empty, the value for
+// empty label value is written without labels.
+type gaugeFunc struct {
+	name, help, label string
+	f                 func() map[string]float64
+}
+
+func (reg *metricsRegistry) gaugeFunc(name, help, label string, f func() map[string]float64) {
+	reg.register(&gaugeFunc{name: name, help: help, label: label, f: f})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	vals := g.f()
+	if g.label == "" {
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(vals[""]))
+		return
+	}
+	labelVals := make([]string, 0, len(vals))
+	for labelVal := range vals {
+		labelVals = append(labelVals, labelVal)
+	}
+	sort.Strings(labelVals)
+	for _, labelVal := range labelVals {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n",
+			g.name, g.label, escapeLabel(labelVal), formatFloat(vals[labelVal]))
+	}
+}
+
+type histogram struct {
+	name, help string
+	mu         sync.Mutex
+	buckets    []float64 // Upper bounds, sorted
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func (reg *metricsRegistry) histogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	reg.register(h)
+	return h
+}
+
+func (h *histogram) Observe(val float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if val <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += val
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// serverMetrics are metrics updated by the server workers.
+type serverMetrics struct {
+	registry        metricsRegistry
+	udpPackets      *counter
+	udpDropped      *counterVec
+	parseErrors     *counter
+	serversRejected *counterVec
+	serversEvicted  *counter
+	gameUpdates     *counterVec
+	listRequests    *counter
+	listSendErrors  *counter
+	listSkipped     *counter
+	httpRequests    *counterVec
+	pings           *counterVec
+	pingRTT         *histogram
+	pingReplies     *counterVec
+	queueDropped    *counterVec
+	tokenChallenges *counter
+	peerSyncs       *counterVec
+	remoteUpdates   *counterVec
+	mirrorSyncs     *counterVec
+
+	policyViolations *counterVec
+	policyDecisions  *counterVec
+}
+
+func gameProtocol(game interface{ IsSentByOrigGame() bool }) string {
+	if game.IsSentByOrigGame() {
+		return "original"
+	}
+	return "modified"
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{}
+	reg := &m.registry
+	m.udpPackets = reg.counter("eimaster_udp_packets_received_total",
+		"Number of UDP packets received from game servers.")
+	m.udpDropped = reg.counterVec("eimaster_udp_packets_dropped_total",
+		"Number of UDP packets dropped without handling by reason.", "reason")
+	m.parseErrors = reg.counter("eimaster_game_info_parse_errors_total",
+		"Number of UDP packets which failed to parse as game info.")
+	m.gameUpdates = reg.counterVec("eimaster_game_updates_total",
+		"Number of game info updates by protocol of the game server.", "protocol")
+	m.serversRejected = reg.counterVec("eimaster_servers_rejected_total",
+		"Number of new game servers which weren't registered by reason.", "reason")
+	m.serversEvicted = reg.counter("eimaster_servers_evicted_total",
+		"Number of game servers removed to register new ones.")
+	m.policyViolations = reg.counterVec("eimaster_content_policy_violations_total",
+		"Number of strings violating the content policy by violation.", "violation")
+	m.policyDecisions = reg.counterVec("eimaster_content_policy_decisions_total",
+		"Number of updates rewritten or rejected by the content policy.", "decision")
+	m.tokenChallenges = reg.counter("eimaster_token_challenges_total",
+		"Number of MasterTokens issued to game servers.")
+	m.peerSyncs = reg.counterVec("eimaster_peer_syncs_total",
+		"Number of registry syncs with peer masters by result.", "result")
+	m.remoteUpdates = reg.counterVec("eimaster_remote_updates_total",
+		"Number of game servers updates got from other masters by origin.", "origin")
+	m.mirrorSyncs = reg.counterVec("eimaster_mirror_syncs_total",
+		"Number of servers list requests to upstream masters by result.", "result")
+	m.listRequests = reg.counter("eimaster_list_requests_total",
+		"Number of servers list requests over TCP.")
+	m.listSendErrors = reg.counter("eimaster_list_send_errors_total",
+		"Number of servers lists which failed to send.")
+	m.listSkipped = reg.counter("eimaster_list_skipped_total",
+		"Number of servers left out of lists sent to games for lack of IPv4 address.")
+	m.httpRequests = reg.counterVec("eimaster_http_requests_total",
+		"Number of HTTP requests by handler.", "handler")
+	m.pings = reg.counterVec("eimaster_pings_total",
+		"Number of game server pings by result.", "result")
+	m.pingRTT = reg.histogram("eimaster_ping_rtt_seconds",
+		"Round trip time of answered game server pings.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.3, 0.5, 1, 2.5})
+	m.pingReplies = reg.counterVec("eimaster_ping_replies_total",
+		"Number of ping replies by their layout.", "layout")
+
+	m.queueDropped = reg.counterVec("eimaster_queue_dropped_total",
+		"Number of tasks dropped because the queue of worker pool was full.", "queue")
+	reg.gaugeFunc("eimaster_queue_length",
+		"Number of tasks waiting in the queue of worker pool.", "queue",
+		func() map[string]float64 {
+			res := make(map[string]float64)
+			for _, p := range []*workerPool{s.packetPool, s.listPool} {
+				res[p.name] = float64(len(p.tasks))
+			}
+			res["updates"] = float64(len(s.updates))
+			res["ping_results"] = float64(len(s.pingResults))
+			return res
+		})
+	reg.gaugeFunc("eimaster_queue_capacity",
+		"Capacity of the queue of worker pool.", "queue",
+		func() map[string]float64 {
+			res := make(map[string]float64)
+			for _, p := range []*workerPool{s.packetPool, s.listPool} {
+				res[p.name] = float64(cap(p.tasks))
+			}
+			res["updates"] = float64(cap(s.updates))
+			res["ping_results"] = float64(cap(s.pingResults))
+			return res
+		})
+
+	reg.gaugeFunc("eimaster_servers_running",
+		"Number of game servers in the registry.", "",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(len(s.registry.Snapshot()))}
+		})
+	reg.gaugeFunc("eimaster_event_subscribers",
+		"Number of clients subscribed to events.", "",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(s.events.subscribersCount())}
+		})
+	reg.gaugeFunc("eimaster_servers_visible",
+		"Number of game servers sent to clients by protocol of the game server.", "protocol",
+		func() map[string]float64 {
+			res := map[string]float64{"original": 0, "modified": 0}
+			for _, srv := range s.visibleServers() {
+				res[gameProtocol(&srv)]++
+			}
+			return res
+		})
+	return m
+}
+
+// countRequests wraps handler to count its requests.
+func (m *serverMetrics) countRequests(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		m.httpRequests.Inc(name)
+		handler(w, req)
+	}
+}
+
+func (m *serverMetrics) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.registry.write(w)
+}
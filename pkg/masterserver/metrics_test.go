@@ -0,0 +1,64 @@
+package masterserver
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	var reg metricsRegistry
+	reg.counter("test_total", "Test counter.").Inc()
+	vec := reg.counterVec("test_vec_total", "Test counter vector.", "kind")
+	vec.Inc("b")
+	vec.Inc("a\"")
+	h := reg.histogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	reg.write(&buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total 1
+# HELP test_vec_total Test counter vector.
+# TYPE test_vec_total counter
+test_vec_total{kind="a\""} 1
+test_vec_total{kind="b"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Modified", PlayerNames: []string{}})
+	waitForServers(t, srv, clock, 1)
+
+	w := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"eimaster_udp_packets_received_total 1\n",
+		"eimaster_game_updates_total{protocol=\"modified\"} 1\n",
+		"eimaster_servers_visible{protocol=\"modified\"} 1\n",
+		"eimaster_servers_running 1\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics don't contain %q:\n%s", line, body)
+		}
+	}
+}
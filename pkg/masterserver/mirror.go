@@ -0,0 +1,116 @@
+package masterserver
+
+import (
+	"context"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Mirrored servers are copied from the lists of upstream masters got by the
+// same protocol the game uses. The list has no timestamps, so every copy is
+// considered updated when the list is received and is removed once it's
+// missing from upstream lists for MirrorTTL. Copies never replace servers
+// registered locally or got from peers.
+
+// mirrorClientID is sent to upstream masters instead of the game client ID.
+const mirrorClientID = 0xDEADBEEF
+
+// mirrorList is the list of servers got from the upstream master.
+type mirrorList struct {
+	upstream string
+	servers  []master.EIServerInfo
+}
+
+// syncMirrors requests lists of upstream masters every time the maintainer
+// asks for it.
+func (s *Server) syncMirrors(ctx context.Context) error {
+	for {
+		select {
+		case <-s.mirrorSync:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		for _, upstream := range s.opts.Mirrors {
+			servers, err := master.GetServersList(upstream, mirrorClientID, s.Config().MirrorInterval)
+			if err != nil {
+				s.metrics.mirrorSyncs.Inc("error")
+				s.log.Warnf("Failed to get servers from upstream %s: %s", upstream, err)
+				continue
+			}
+			s.metrics.mirrorSyncs.Inc("success")
+			s.log.Debugf("Got %d servers from upstream %s", len(servers), upstream)
+			select {
+			case s.mirrorUpdates <- mirrorList{upstream: upstream, servers: servers}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// mergeMirrored stores servers got from the upstream master. It's called by
+// the maintainer only.
+func (s *Server) mergeMirrored(list mirrorList, cfg *Config) {
+	now := s.clock.Now()
+	for i := range list.servers {
+		mirrored := &list.servers[i]
+		if !s.applyPolicy(mirrored) || s.banned(mirrored) {
+			continue
+		}
+		mirrored.Mirror = list.upstream
+		mirrored.AppearTime, mirrored.LastUpdate = now, now
+
+		matches := s.registry.List(func(srv *master.EIServerInfo) bool {
+			return srv.Addr.String() == mirrored.Addr.String() || srv.Equals(mirrored)
+		})
+		var existing *master.EIServerInfo
+		firstHand := false
+		for j := range matches {
+			if matches[j].Mirror == "" {
+				firstHand = true
+			} else {
+				existing = &matches[j]
+			}
+		}
+		if firstHand {
+			// The game server is known first hand, the copy is not needed.
+			continue
+		}
+		if existing != nil {
+			mirrored.ID = existing.ID
+			mirrored.AppearTime = existing.AppearTime
+			mirrored.Ping = existing.Ping
+			mirrored.PingStats = existing.PingStats
+			mirrored.LastSuccessfulPing = existing.LastSuccessfulPing
+		} else if reason := s.checkCopyQuota(cfg); reason != "" {
+			s.metrics.serversRejected.Inc(reason)
+			s.log.Warnf("Mirrored server %s from %s is rejected: %s", mirrored, list.upstream, reason)
+			continue
+		}
+
+		storedSrv, err := s.registry.Upsert(mirrored)
+		if err != nil {
+			s.log.Errorf("Failed to store mirrored server %s: %s", mirrored, err)
+			continue
+		}
+		s.serverStored(storedSrv)
+	}
+}
+
+// expireMirrored removes mirrored servers which haven't been seen in upstream
+// lists for MirrorTTL.
+func (s *Server) expireMirrored(cfg *Config) {
+	before := s.clock.Now().Add(-cfg.MirrorTTL)
+	expired := s.registry.List(func(srv *master.EIServerInfo) bool {
+		return srv.Mirror != "" && srv.LastUpdate.Before(before)
+	})
+	for i := range expired {
+		s.log.Debugf("Mirrored server %s is gone from %s, removing...", &expired[i], expired[i].Mirror)
+		if _, err := s.registry.Remove(expired[i].ID); err != nil {
+			s.log.Errorf("Failed to remove mirrored server %s: %s", &expired[i], err)
+			continue
+		}
+		s.serverRemoved(&expired[i])
+	}
+}
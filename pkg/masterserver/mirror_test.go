@@ -0,0 +1,63 @@
+package masterserver
+
+import (
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestMirror(t *testing.T) {
+	upstream := startTestServer(t, Options{})
+	sendGame(t, upstream, &master.EIGameInfo{ClientID: 1, Name: "Upstream", PlayerNames: []string{}})
+	waitForServers(t, upstream, upstream.opts.Clock.(*fakeClock), 1)
+
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{
+		Clock:   clock,
+		Mirrors: []string{upstream.Addr().String()},
+		Config:  Config{SendDelay: time.Millisecond},
+	})
+	servers := waitForServers(t, srv, clock, 1)
+	if servers[0].Name != "Upstream" || servers[0].Mirror != upstream.Addr().String() {
+		t.Errorf("Unexpected mirrored server: %+v", servers[0])
+	}
+
+	// The game registered locally replaces its copy
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Upstream", PlayersCount: 3, PlayerNames: []string{}})
+	for i := 0; i < 100; i++ {
+		clock.Advance(10 * time.Second)
+		servers = getJSONList(t, srv)
+		if len(servers) == 1 && servers[0].Mirror == "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(servers) != 1 || servers[0].Mirror != "" || servers[0].PlayersCount != 3 {
+		t.Fatalf("Local server hasn't replaced the copy: %+v", servers)
+	}
+	for i := 0; i < 10; i++ {
+		clock.Advance(10 * time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if servers := getJSONList(t, srv); len(servers) != 1 || servers[0].Mirror != "" {
+		t.Errorf("Copy of local server is added again: %+v", servers)
+	}
+}
+
+func TestMirrorTTL(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	srv.mirrorUpdates <- mirrorList{
+		upstream: "upstream:28004",
+		servers:  []master.EIServerInfo{*newTestServerInfo(1, "Copy", time.Time{})},
+	}
+	waitForServers(t, srv, clock, 1)
+	// The last tick makes sure the previous one is handled
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Minute)
+	}
+	if servers := srv.Registry().Snapshot(); len(servers) != 0 {
+		t.Errorf("Mirrored server isn't removed after TTL: %+v", servers)
+	}
+}
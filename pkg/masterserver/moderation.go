@@ -0,0 +1,408 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Moderators ban game servers by IP or CIDR and by regular expressions
+// matching Name, Quest or any of player names. Banned updates are dropped by
+// the receiver, copies got from peers and mirrors are ignored, and registered
+// servers matching a new ban are removed. Moderators also tag and pin
+// servers, marks are kept until the server is removed. Bans and marks are
+// saved to the moderation file after every change, every action is appended
+// to the audit log.
+
+const (
+	banIP     = "ip"     // Pattern is IP or CIDR
+	banName   = "name"   // Pattern is regexp matching Name
+	banQuest  = "quest"  // Pattern is regexp matching Quest
+	banPlayer = "player" // Pattern is regexp matching any of PlayerNames
+)
+
+// auditHistory is the number of recent audit entries kept in memory.
+const auditHistory = 1000
+
+type banRule struct {
+	ID      uint64    `json:"id"`
+	Kind    string    `json:"kind"`
+	Pattern string    `json:"pattern"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+
+	ipNet *net.IPNet
+	re    *regexp.Regexp
+}
+
+// compile parses the pattern of the rule.
+func (rule *banRule) compile() error {
+	switch rule.Kind {
+	case banIP:
+		if strings.Contains(rule.Pattern, "/") {
+			_, ipNet, err := net.ParseCIDR(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %q", rule.Pattern)
+			}
+			rule.ipNet = ipNet
+			return nil
+		}
+		ip := net.ParseIP(rule.Pattern)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %q", rule.Pattern)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case banName, banQuest, banPlayer:
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+		}
+		rule.re = re
+	default:
+		return fmt.Errorf("unknown ban kind %q", rule.Kind)
+	}
+	return nil
+}
+
+func (rule *banRule) matches(srv *master.EIServerInfo) bool {
+	switch rule.Kind {
+	case banIP:
+		return rule.ipNet.Contains(srv.Addr.IP)
+	case banName:
+		return rule.re.MatchString(srv.Name)
+	case banQuest:
+		return rule.re.MatchString(srv.Quest)
+	case banPlayer:
+		for _, name := range srv.PlayerNames {
+			if rule.re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverMark is set by moderators to the registered server.
+type serverMark struct {
+	Tags   []string `json:"tags,omitempty"`
+	Pinned int      `json:"pinned,omitempty"`
+}
+
+// moderationData is saved to the moderation file as JSON.
+type moderationData struct {
+	LastBanID uint64                 `json:"last_ban_id"`
+	Bans      []*banRule             `json:"bans"`
+	Marks     map[uint64]*serverMark `json:"marks"` // By server ID
+}
+
+type auditEntry struct {
+	Time    time.Time   `json:"time"`
+	Remote  string      `json:"remote"`
+	Action  string      `json:"action"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type moderation struct {
+	mu        sync.RWMutex
+	path      string // Moderation file, data is kept in memory only if empty
+	auditPath string // Audit log file, entries are kept in memory only if empty
+	data      moderationData
+	audit     []auditEntry // Recent entries
+}
+
+func newModeration(path, auditPath string) *moderation {
+	return &moderation{
+		path:      path,
+		auditPath: auditPath,
+		data:      moderationData{Marks: make(map[uint64]*serverMark)},
+	}
+}
+
+// load reads the moderation file. Missing file is not an error. Marks are
+// dropped unless keepMarks is set, i.e. server IDs are the same as before
+// restart.
+func (m *moderation) load(keepMarks bool) error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var loaded moderationData
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	for _, rule := range loaded.Bans {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("ban %d: %w", rule.ID, err)
+		}
+	}
+	if loaded.Marks == nil || !keepMarks {
+		loaded.Marks = make(map[uint64]*serverMark)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = loaded
+	return nil
+}
+
+// save writes the moderation file, m.mu must be held.
+func (m *moderation) save() error {
+	if m.path == "" {
+		return nil
+	}
+	return writeFileAtomic(m.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&m.data)
+	})
+}
+
+// check returns the first ban matching srv or nil.
+func (m *moderation) check(srv *master.EIServerInfo) *banRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, rule := range m.data.Bans {
+		if rule.matches(srv) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (m *moderation) bans() []banRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]banRule, 0, len(m.data.Bans))
+	for _, rule := range m.data.Bans {
+		result = append(result, *rule)
+	}
+	return result
+}
+
+// addBan stores the compiled rule, the rule gets ID and creation time. The
+// rule isn't added if the file can't be saved.
+func (m *moderation) addBan(rule *banRule, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := m.data.Bans
+	m.data.LastBanID++
+	rule.ID, rule.Created = m.data.LastBanID, now
+	m.data.Bans = append(m.data.Bans, rule)
+	if err := m.save(); err != nil {
+		m.data.LastBanID--
+		m.data.Bans = bans
+		return err
+	}
+	return nil
+}
+
+// removeBan returns false if there is no such ban. The ban is kept if the
+// file can't be saved.
+func (m *moderation) removeBan(id uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, rule := range m.data.Bans {
+		if rule.ID == id {
+			bans := m.data.Bans
+			m.data.Bans = append(append([]*banRule{}, bans[:i]...), bans[i+1:]...)
+			if err := m.save(); err != nil {
+				m.data.Bans = bans
+				return true, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setMark sets the mark of the server, empty mark is removed. The mark isn't
+// changed if the file can't be saved.
+func (m *moderation) setMark(id uint64, mark *serverMark) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, hadPrev := m.data.Marks[id]
+	if len(mark.Tags) == 0 && mark.Pinned == 0 {
+		delete(m.data.Marks, id)
+	} else {
+		m.data.Marks[id] = mark
+	}
+	if err := m.save(); err != nil {
+		if hadPrev {
+			m.data.Marks[id] = prev
+		} else {
+			delete(m.data.Marks, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// forget removes the mark of the removed server.
+func (m *moderation) forget(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.Marks[id]; !ok {
+		return nil
+	}
+	delete(m.data.Marks, id)
+	return m.save()
+}
+
+// applyTo sets the mark of the server, or clears it if the server isn't
+// marked.
+func (m *moderation) applyTo(srv *master.EIServerInfo) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	srv.Tags, srv.Pinned = nil, 0
+	if mark, ok := m.data.Marks[srv.ID]; ok {
+		srv.Tags = append([]string(nil), mark.Tags...)
+		srv.Pinned = mark.Pinned
+	}
+}
+
+// apply sets marks to the servers and moves pinned servers to the front.
+func (m *moderation) apply(servers []master.EIServerInfo) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.data.Marks) == 0 {
+		return
+	}
+	for i := range servers {
+		if mark, ok := m.data.Marks[servers[i].ID]; ok {
+			servers[i].Tags = append([]string(nil), mark.Tags...)
+			servers[i].Pinned = mark.Pinned
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		less, _ := pinnedLess(&servers[i], &servers[j])
+		return less
+	})
+}
+
+// pinnedLess orders pinned servers before the rest. It returns false as the
+// second value if both servers have the same position.
+func pinnedLess(a, b *master.EIServerInfo) (less, ok bool) {
+	switch {
+	case a.Pinned == b.Pinned:
+		return false, false
+	case a.Pinned == 0:
+		return false, true
+	case b.Pinned == 0:
+		return true, true
+	default:
+		return a.Pinned < b.Pinned, true
+	}
+}
+
+// record appends the entry to the audit log.
+func (m *moderation) record(entry auditEntry) error {
+	m.mu.Lock()
+	m.audit = append(m.audit, entry)
+	if len(m.audit) > auditHistory {
+		m.audit = append(m.audit[:0], m.audit[len(m.audit)-auditHistory:]...)
+	}
+	m.mu.Unlock()
+
+	if m.auditPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// recentAudit returns audit entries recorded since start, the newest last.
+func (m *moderation) recentAudit() []auditEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]auditEntry{}, m.audit...)
+}
+
+// removal asks the maintainer to remove registered servers accepted by filter.
+// Removed servers are sent to done.
+type removal struct {
+	filter func(srv *master.EIServerInfo) bool
+	done   chan []master.EIServerInfo
+}
+
+// removeServers removes servers by the maintainer and returns them. Once the
+// maintainer has got the request, it always completes it, so an error means
+// nothing is removed.
+func (s *Server) removeServers(filter func(srv *master.EIServerInfo) bool) ([]master.EIServerInfo, error) {
+	done := s.serverDone()
+	if done == nil {
+		return nil, errNotStarted
+	}
+	r := removal{filter: filter, done: make(chan []master.EIServerInfo, 1)}
+	select {
+	case s.removals <- r:
+	case <-done:
+		return nil, s.ctx.Err()
+	}
+	return <-r.done, nil
+}
+
+// markChanged publishes the server again after its mark is changed.
+func (s *Server) markChanged(id uint64) {
+	done := s.serverDone()
+	if done == nil {
+		return
+	}
+	select {
+	case s.markChanges <- id:
+	case <-done:
+	}
+}
+
+// remove removes servers of the request, it's called by the maintainer only.
+func (s *Server) remove(r removal) {
+	var removed []master.EIServerInfo
+	for _, srv := range s.registry.List(r.filter) {
+		if _, err := s.registry.Remove(srv.ID); err != nil {
+			s.log.Errorf("Failed to remove server %s: %s", &srv, err)
+			continue
+		}
+		s.log.Infof("Server %s is removed by moderator", &srv)
+		s.serverRemoved(&srv)
+		removed = append(removed, srv)
+	}
+	r.done <- removed
+}
+
+// banned returns true if srv is banned. The reason is logged.
+func (s *Server) banned(srv *master.EIServerInfo) bool {
+	rule := s.moderation.check(srv)
+	if rule == nil {
+		return false
+	}
+	s.log.Debugf("Server %s is banned by rule %d (%s %q)", srv, rule.ID, rule.Kind, rule.Pattern)
+	return true
+}
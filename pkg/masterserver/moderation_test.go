@@ -0,0 +1,205 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBanRules(t *testing.T) {
+	srv := newTestServerInfo(1, "Troll server", time.Now())
+	srv.Addr = net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 8888}
+	srv.PlayerNames = []string{"Spammer"}
+	for _, tc := range []struct {
+		kind, pattern string
+		matches       bool
+	}{
+		{banIP, "10.1.2.3", true},
+		{banIP, "10.1.0.0/16", true},
+		{banIP, "10.2.0.0/16", false},
+		{banName, "^Troll", true},
+		{banName, "(?i)^troll", true},
+		{banQuest, "Troll", false},
+		{banPlayer, "spam", false},
+		{banPlayer, "(?i)spam", true},
+	} {
+		rule := banRule{Kind: tc.kind, Pattern: tc.pattern}
+		if err := rule.compile(); err != nil {
+			t.Errorf("Failed to compile %s %q: %s", tc.kind, tc.pattern, err)
+		} else if rule.matches(srv) != tc.matches {
+			t.Errorf("Unexpected match of %s %q: %v", tc.kind, tc.pattern, !tc.matches)
+		}
+	}
+	for _, rule := range []banRule{{Kind: banIP, Pattern: "10.1"}, {Kind: banName, Pattern: "("},
+		{Kind: "addr", Pattern: "x"}} {
+		if err := rule.compile(); err == nil {
+			t.Errorf("Invalid ban %s %q is compiled", rule.Kind, rule.Pattern)
+		}
+	}
+}
+
+func TestModerationAPI(t *testing.T) {
+	dir := t.TempDir()
+	modPath, auditPath := filepath.Join(dir, "moderation.json"), filepath.Join(dir, "audit.log")
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, AdminToken: "secret",
+		ModerationPath: modPath, AuditLogPath: auditPath})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha"})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 2, Name: "Troll"})
+	waitForServers(t, srv, clock, 2)
+
+	request := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+	if w := request("GET", "/moderation/bans", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Bans are served with wrong token: %d", w.Code)
+	}
+	if w := request("POST", "/moderation/bans", "secret", `{"kind": "name", "pattern": "("}`); w.Code != 400 {
+		t.Errorf("Invalid ban is added: %d", w.Code)
+	}
+
+	w := request("POST", "/moderation/bans", "secret", `{"kind": "name", "pattern": "^Troll", "reason": "spam"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to add ban: %d %s", w.Code, w.Body)
+	}
+	if servers := getJSONList(t, srv); len(servers) != 1 || servers[0].Name != "Alpha" {
+		t.Errorf("Banned server isn't removed: %+v", servers)
+	}
+	// Updates of banned servers are dropped
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 2, Name: "Troll"})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 3, Name: "Beta"})
+	servers := waitForServers(t, srv, clock, 2)
+	clock.Advance(time.Second)
+	if servers := getJSONList(t, srv); len(servers) != 2 {
+		t.Errorf("Unexpected servers after ban: %+v", servers)
+	}
+
+	beta := servers[0]
+	if beta.Name != "Beta" {
+		beta = servers[1]
+	}
+	w = request("PUT", fmt.Sprintf("/moderation/servers/%d", beta.ID), "secret",
+		`{"tags": ["official"], "pinned": 1}`)
+	if w.Code != 200 {
+		t.Fatalf("Failed to mark server: %d %s", w.Code, w.Body)
+	}
+	if servers := getJSONList(t, srv); servers[0].ID != beta.ID || len(servers[0].Tags) != 1 ||
+		servers[0].Pinned != 1 {
+		t.Errorf("Server isn't pinned: %+v", servers)
+	}
+
+	alphaID := servers[0].ID + servers[1].ID - beta.ID
+	if w := request("DELETE", fmt.Sprintf("/moderation/servers/%d", alphaID), "secret", ""); w.Code != 204 {
+		t.Errorf("Failed to remove server: %d %s", w.Code, w.Body)
+	}
+	if w := request("DELETE", fmt.Sprintf("/moderation/servers/%d", alphaID), "secret", ""); w.Code != 404 {
+		t.Errorf("Removed server is removed again: %d", w.Code)
+	}
+	if servers := getJSONList(t, srv); len(servers) != 1 || servers[0].ID != beta.ID {
+		t.Errorf("Server isn't removed: %+v", servers)
+	}
+
+	var audit []auditEntry
+	w = request("GET", "/moderation/audit", "secret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &audit); err != nil || len(audit) != 3 ||
+		audit[0].Action != "ban" || audit[2].Action != "remove" {
+		t.Errorf("Unexpected audit: %s", w.Body)
+	}
+	data, err := ioutil.ReadFile(auditPath)
+	if err != nil || bytes.Count(data, []byte("\n")) != 3 {
+		t.Errorf("Unexpected audit log: %s %v", data, err)
+	}
+
+	loaded := newModeration(modPath, "")
+	if err := loaded.load(true); err != nil {
+		t.Fatal(err)
+	}
+	if bans := loaded.bans(); len(bans) != 1 || bans[0].Reason != "spam" || loaded.data.Marks[beta.ID] == nil {
+		t.Errorf("Unexpected moderation file: %+v", loaded.data)
+	}
+}
+
+func TestModerationDisabled(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/moderation/bans", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Moderation is served without admin token: %d", w.Code)
+	}
+}
+
+func TestModerationErrors(t *testing.T) {
+	request := func(srv *Server, method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+	ban := `{"kind": "name", "pattern": "^Troll"}`
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	// The server isn't started, so servers can't be removed, but the ban is
+	// in effect and audited.
+	srv := New(Options{AdminToken: "secret", Logger: logger})
+	if w := request(srv, "POST", "/moderation/bans", ban); w.Code != http.StatusCreated {
+		t.Errorf("Unexpected status of ban before start: %d %s", w.Code, w.Body)
+	}
+	if audit := srv.moderation.recentAudit(); len(audit) != 1 || audit[0].Action != "ban" {
+		t.Errorf("Ban before start isn't audited: %+v", audit)
+	}
+	if w := request(srv, "DELETE", "/moderation/servers/1", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status of removal before start: %d %s", w.Code, w.Body)
+	}
+	if audit := srv.moderation.recentAudit(); len(audit) != 1 {
+		t.Errorf("Failed removal is audited: %+v", audit)
+	}
+
+	// The ban which can't be saved isn't added.
+	srv = New(Options{AdminToken: "secret", Logger: logger,
+		ModerationPath: filepath.Join(t.TempDir(), "missing", "moderation.json")})
+	if w := request(srv, "POST", "/moderation/bans", ban); w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status of unsaved ban: %d %s", w.Code, w.Body)
+	}
+	if bans := srv.moderation.bans(); len(bans) != 0 {
+		t.Errorf("Unsaved ban is added: %+v", bans)
+	}
+}
+
+func TestModerationMarksNeedIDs(t *testing.T) {
+	modPath := filepath.Join(t.TempDir(), "moderation.json")
+	data := []byte(`{"last_ban_id": 0, "bans": [], "marks": {"1": {"pinned": 1}}}`)
+	if err := ioutil.WriteFile(modPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs of the memory registry start from 1 again, the mark would be
+	// attached to another server.
+	srv := startTestServer(t, Options{ModerationPath: modPath})
+	if len(srv.moderation.data.Marks) != 0 {
+		t.Errorf("Marks are loaded with memory registry: %+v", srv.moderation.data.Marks)
+	}
+	srv = startTestServer(t, Options{ModerationPath: modPath, StatePath: tempStatePath(t)})
+	if srv.moderation.data.Marks[1] == nil {
+		t.Errorf("Marks aren't loaded with file registry: %+v", srv.moderation.data.Marks)
+	}
+}
@@ -0,0 +1,288 @@
+package masterserver
+
+// openAPISpec describes REST API v1, it's served at /api/v1/openapi.json.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Evil Islands master server API",
+    "version": "1"
+  },
+  "paths": {
+    "/api/v1/servers": {
+      "get": {
+        "summary": "List visible game servers",
+        "parameters": [
+          {"name": "allod", "in": "query", "schema": {"type": "integer", "minimum": 0, "maximum": 255}},
+          {"name": "has_password", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "not_full", "in": "query", "schema": {"type": "boolean"},
+           "description": "Only servers with free player slots"},
+          {"name": "min_players", "in": "query", "schema": {"type": "integer", "minimum": 0}},
+          {"name": "name", "in": "query", "schema": {"type": "string"},
+           "description": "Case insensitive substring of the server name"},
+          {"name": "quest", "in": "query", "schema": {"type": "string"},
+           "description": "Case insensitive substring of the quest"},
+          {"name": "sort", "in": "query",
+           "schema": {"type": "string", "default": "id",
+                      "enum": ["id", "name", "quest", "allod", "players", "ping", "appear_time",
+                               "last_update", "-id", "-name", "-quest", "-allod", "-players", "-ping",
+                               "-appear_time", "-last_update"]},
+           "description": "Sort key, prefix - sorts in descending order"},
+          {"name": "offset", "in": "query", "schema": {"type": "integer", "minimum": 0, "default": 0}},
+          {"name": "limit", "in": "query",
+           "schema": {"type": "integer", "minimum": 0, "maximum": 1000, "default": 100}},
+          {"$ref": "#/components/parameters/IfNoneMatch"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of servers",
+            "headers": {"ETag": {"schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServersPage"}}}
+          },
+          "304": {"description": "Servers haven't changed since the ETag"},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/servers/{id}": {
+      "get": {
+        "summary": "Get visible game server by ID",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+          {"$ref": "#/components/parameters/IfNoneMatch"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Server",
+            "headers": {"ETag": {"schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Server"}}}
+          },
+          "304": {"description": "Server hasn't changed since the ETag"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/history": {
+      "get": {
+        "summary": "Get history of player counts of all servers",
+        "parameters": [
+          {"$ref": "#/components/parameters/Resolution"},
+          {"$ref": "#/components/parameters/From"},
+          {"$ref": "#/components/parameters/To"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Series",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/History"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/servers/{id}/history": {
+      "get": {
+        "summary": "Get history of player counts and availability of the server",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+          {"$ref": "#/components/parameters/Resolution"},
+          {"$ref": "#/components/parameters/From"},
+          {"$ref": "#/components/parameters/To"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Series",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/History"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/players": {
+      "get": {
+        "summary": "Search players of modified game servers",
+        "parameters": [
+          {"name": "q", "in": "query", "schema": {"type": "string"},
+           "description": "Case insensitive substring of the name, Cyrillic and Latin letters match each other"},
+          {"name": "online", "in": "query", "schema": {"type": "boolean"},
+           "description": "Only players listed by visible servers"},
+          {"name": "limit", "in": "query",
+           "schema": {"type": "integer", "minimum": 0, "maximum": 1000, "default": 100}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Players sorted by name",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PlayersPage"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/players/{name}": {
+      "get": {
+        "summary": "Get player by case insensitive or transliterated name",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Player",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Player"}}}
+          },
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/events": {
+      "get": {
+        "summary": "Stream changes of visible servers",
+        "description": "Events are sent as Server-Sent Events or as WebSocket text messages if the client asks for upgrade. The stream starts with the snapshot event unless it's resumed.",
+        "parameters": [
+          {"name": "last_event_id", "in": "query", "schema": {"type": "integer"},
+           "description": "ID of the last event got, resumes the stream"},
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "integer"}}
+        ],
+        "responses": {
+          "101": {"description": "WebSocket stream of Event messages"},
+          "200": {
+            "description": "Stream of events",
+            "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/Event"}}}
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "IfNoneMatch": {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}},
+      "Resolution": {"name": "resolution", "in": "query",
+                     "schema": {"type": "string", "enum": ["1m", "1h"], "default": "1m"}},
+      "From": {"name": "from", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+      "To": {"name": "to", "in": "query", "schema": {"type": "string", "format": "date-time"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "Error",
+        "content": {
+          "application/json": {
+            "schema": {"type": "object", "properties": {"error": {"type": "string"}}}
+          }
+        }
+      }
+    },
+    "schemas": {
+      "ServersPage": {
+        "type": "object",
+        "properties": {
+          "total": {"type": "integer", "description": "Number of servers matching filters"},
+          "offset": {"type": "integer"},
+          "limit": {"type": "integer"},
+          "servers": {"type": "array", "items": {"$ref": "#/components/schemas/Server"}}
+        }
+      },
+      "History": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "description": "Server ID, for server series only"},
+          "resolution": {"type": "string"},
+          "availability": {"type": "number", "description": "Percent of time the server was visible"},
+          "uptime": {"type": "number", "description": "Percent of visible time the server answered pings"},
+          "points": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "time": {"type": "string", "format": "date-time"},
+                "players_avg": {"type": "number"},
+                "players_max": {"type": "integer"},
+                "servers_avg": {"type": "number", "description": "For global series only"}
+              }
+            }
+          }
+        }
+      },
+      "PlayersPage": {
+        "type": "object",
+        "properties": {
+          "total": {"type": "integer", "description": "Number of players matching the query"},
+          "players": {"type": "array", "items": {"$ref": "#/components/schemas/Player"}}
+        }
+      },
+      "Player": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "online": {"type": "boolean"},
+          "server_id": {"type": "integer", "description": "Current server, for online players only"},
+          "last_seen": {"type": "string", "format": "date-time"},
+          "last_server_id": {"type": "integer"},
+          "last_server_name": {"type": "string"},
+          "last_server_addr": {"type": "string"}
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "type": {"type": "string", "enum": ["snapshot", "add", "update", "hide", "remove"]},
+          "time": {"type": "string", "format": "date-time"},
+          "server": {"$ref": "#/components/schemas/Server"},
+          "servers": {"type": "array", "items": {"$ref": "#/components/schemas/Server"},
+                      "description": "Visible servers, for snapshot only"}
+        }
+      },
+      "Server": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "description": "Stable while the server is registered"},
+          "addr": {"$ref": "#/components/schemas/Addr"},
+          "name": {"type": "string"},
+          "quest": {"type": "string"},
+          "players_count": {"type": "integer"},
+          "max_players_count": {"type": "integer"},
+          "has_password": {"type": "boolean"},
+          "allod_index": {"type": "integer"},
+          "player_names": {"type": "array", "items": {"type": "string"}},
+          "appear_time": {"type": "string", "format": "date-time"},
+          "last_update": {"type": "string", "format": "date-time"},
+          "ping": {"type": "integer", "description": "Rounded ping_stats.rtt, 0 if never answered"},
+          "ping_stats": {"$ref": "#/components/schemas/PingStats"},
+          "last_successful_ping": {"type": "string", "format": "date-time"},
+          "token_verified": {"type": "boolean"},
+          "origin": {"type": "string", "description": "Peer master the server is registered on"},
+          "origin_id": {"type": "integer"},
+          "hops": {"type": "integer"},
+          "mirror": {"type": "string", "description": "Upstream master the server is copied from"},
+          "endpoints": {
+            "type": "array",
+            "description": "Candidate addresses of the server, addr is chosen from them",
+            "items": {"$ref": "#/components/schemas/Endpoint"}
+          }
+        }
+      },
+      "Endpoint": {
+        "type": "object",
+        "properties": {
+          "addr": {"$ref": "#/components/schemas/Addr"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time", "description": "Time of the last update from the address"},
+          "ping_stats": {"$ref": "#/components/schemas/PingStats"},
+          "last_successful_ping": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Addr": {
+        "type": "object",
+        "properties": {"IP": {"type": "string"}, "Port": {"type": "integer"}, "Zone": {"type": "string"}}
+      },
+      "PingStats": {
+        "type": "object",
+        "properties": {
+          "rtt": {"type": "number", "description": "Moving average of round trip time, milliseconds"},
+          "jitter": {"type": "number", "description": "Mean deviation of round trip time, milliseconds"},
+          "loss": {"type": "number", "description": "Moving average of the share of lost probes, 0 to 1"},
+          "sent": {"type": "integer"},
+          "received": {"type": "integer"}
+        }
+      }
+    }
+  }
+}`
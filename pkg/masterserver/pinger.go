@@ -0,0 +1,303 @@
+package masterserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// The pinger probes game servers from one UDP socket and matches replies by
+// their source address. Every target is probed every PingInterval, the
+// interval is doubled after every unanswered probe up to PingMaxInterval and
+// is reset by a reply. Probes are sent and timed out by the maintainer on
+// refresh, so the schedule follows the server clock and is as precise as
+// RefreshInterval, while RTT is measured by the monotonic clock when the reply
+// comes. Replies after the timeout are lost too, even if the refresh hasn't
+// timed out their probes yet. All endpoints of the server are probed, see endpoints.go. The last
+// reply of every server is kept to be shown by the admin API, see
+// servePingReply.
+
+type pingResult struct {
+	id       uint64
+	addr     net.UDPAddr
+	stats    master.PingStats
+	answered bool
+}
+
+type pingTarget struct {
+	id       uint64 // Server the address belongs to
+	addr     net.UDPAddr
+	stats    master.PingStats
+	interval time.Duration
+	next     time.Time // Time of the next probe by the server clock
+	deadline time.Time // Timeout of the pending probe by the server clock
+	sentAt   time.Time // Time the pending probe was sent, zero if there is none
+}
+
+// capturedReply is the last reply of the game server.
+type capturedReply struct {
+	time  time.Time
+	addr  net.UDPAddr
+	data  []byte
+	reply *master.PingReply // Nil if the layout is unknown
+	err   error             // Decoding error
+}
+
+type pinger struct {
+	mu      sync.Mutex
+	targets map[string]*pingTarget    // By address
+	replies map[uint64]*capturedReply // By server ID
+}
+
+func newPinger() *pinger {
+	return &pinger{
+		targets: make(map[string]*pingTarget),
+		replies: make(map[uint64]*capturedReply),
+	}
+}
+
+// watchPing starts probing the address of the server. New addresses are
+// probed at once, false is returned with the result if the probe can't be
+// sent. It's called by the maintainer only.
+func (s *Server) watchPing(id uint64, addr net.UDPAddr, cfg *Config) (pingResult, bool) {
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	if target, ok := s.pinger.targets[addr.String()]; ok {
+		target.id = id
+		return pingResult{}, true
+	}
+	target := &pingTarget{id: id, addr: addr, interval: cfg.PingInterval}
+	s.pinger.targets[addr.String()] = target
+	return s.sendProbe(target, cfg)
+}
+
+// forgetPing stops probing the address.
+func (s *Server) forgetPing(addr *net.UDPAddr) {
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	delete(s.pinger.targets, addr.String())
+}
+
+// forgetServerPings stops probing all addresses of the server.
+func (s *Server) forgetServerPings(id uint64) {
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	for key, target := range s.pinger.targets {
+		if target.id == id {
+			delete(s.pinger.targets, key)
+		}
+	}
+	delete(s.pinger.replies, id)
+}
+
+// schedulePings accounts the probes which haven't been answered in time and
+// sends the probes which are due. Results of lost probes and probes which
+// can't be sent are returned. It's called by the maintainer only.
+func (s *Server) schedulePings(cfg *Config) []pingResult {
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	var lost []pingResult
+	for _, target := range s.pinger.targets {
+		if !target.sentAt.IsZero() && s.clock.Now().After(target.deadline) {
+			s.metrics.pings.Inc("timeout")
+			lost = append(lost, s.probeLost(target, cfg))
+		}
+		if target.sentAt.IsZero() && !s.clock.Now().Before(target.next) {
+			if result, ok := s.sendProbe(target, cfg); !ok {
+				lost = append(lost, result)
+			}
+		}
+	}
+	return lost
+}
+
+// sendProbe sends the probe to the target, s.pinger.mu must be held. If the
+// probe can't be sent, it's accounted as lost and false is returned with the
+// result.
+func (s *Server) sendProbe(target *pingTarget, cfg *Config) (pingResult, bool) {
+	if s.pingConn == nil {
+		return pingResult{}, true
+	}
+	target.sentAt = time.Now()
+	target.deadline = s.clock.Now().Add(cfg.PingTimeout)
+	if _, err := s.pingConn.WriteTo(master.PingProbe, &target.addr); err != nil {
+		s.metrics.pings.Inc("error")
+		s.log.Errorf("Failed to ping %s: %s", &target.addr, err)
+		return s.probeLost(target, cfg), false
+	}
+	return pingResult{}, true
+}
+
+// probeLost backs off the target, s.pinger.mu must be held.
+func (s *Server) probeLost(target *pingTarget, cfg *Config) pingResult {
+	target.stats.AddLoss()
+	target.sentAt = time.Time{}
+	target.interval *= 2
+	if target.interval > cfg.PingMaxInterval {
+		target.interval = cfg.PingMaxInterval
+	}
+	target.next = s.clock.Now().Add(target.interval)
+	return pingResult{id: target.id, addr: target.addr, stats: target.stats}
+}
+
+// probeAnswered accounts the reply from addr. It returns false if there is no
+// pending probe to the address. The reply which comes after the deadline of
+// the probe is accounted as loss.
+func (s *Server) probeAnswered(addr net.Addr) (pingResult, bool) {
+	cfg := s.Config()
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	target, ok := s.pinger.targets[addr.String()]
+	if !ok || target.sentAt.IsZero() {
+		return pingResult{}, false
+	}
+	if s.clock.Now().After(target.deadline) {
+		s.metrics.pings.Inc("timeout")
+		return s.probeLost(target, &cfg), true
+	}
+	rtt := time.Since(target.sentAt)
+	s.metrics.pings.Inc("answered")
+	s.metrics.pingRTT.Observe(rtt.Seconds())
+	target.stats.AddReply(rtt)
+	target.sentAt = time.Time{}
+	target.interval = cfg.PingInterval
+	target.next = s.clock.Now().Add(target.interval)
+	return pingResult{id: target.id, addr: target.addr, stats: target.stats, answered: true}, true
+}
+
+// pingReceiver reads replies to the probes and passes them to the maintainer.
+func (s *Server) pingReceiver(ctx context.Context) error {
+	defer s.pingConn.Close()
+
+	doneChan := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := s.pingConn.ReadFrom(buffer)
+			if err != nil {
+				doneChan <- err
+				return
+			}
+			if result, ok := s.probeAnswered(addr); ok {
+				s.captureReply(&result, append([]byte(nil), buffer[:n]...))
+				select {
+				case s.pingResults <- result:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-doneChan:
+		return err
+	}
+}
+
+// applyPingResult updates the endpoint of the server the result belongs to
+// and chooses the published address again. It's called by the maintainer only.
+func (s *Server) applyPingResult(result *pingResult) {
+	existingSrv := s.registry.Find(&master.EIServerInfo{ID: result.id})
+	if existingSrv == nil {
+		s.forgetPing(&result.addr)
+		return
+	}
+	existingSrv.Endpoints = endpointsOf(existingSrv)
+	endpoint := existingSrv.Endpoint(&result.addr)
+	if endpoint == nil {
+		s.forgetPing(&result.addr)
+		return
+	}
+
+	endpoint.PingStats = result.stats
+	if result.answered {
+		endpoint.LastSuccessfulPing = s.clock.Now()
+	}
+	selectEndpoint(existingSrv, s.clock.Now().Add(-s.Config().VisibleFor))
+	storedSrv, err := s.registry.Upsert(existingSrv)
+	if err != nil {
+		s.log.Errorf("Failed to store server %s: %s", existingSrv, err)
+		return
+	}
+	s.serverStored(storedSrv)
+}
+
+// captureReply decodes the reply and keeps it as the last one of the server.
+func (s *Server) captureReply(result *pingResult, data []byte) {
+	captured := &capturedReply{time: s.clock.Now(), addr: result.addr, data: data}
+	captured.reply, captured.err = master.DecodePingReply(data)
+	if captured.reply != nil {
+		s.metrics.pingReplies.Inc(captured.reply.Layout)
+		srv := s.registry.Find(&master.EIServerInfo{ID: result.id})
+		if srv != nil {
+			if names := captured.reply.Mismatches(&srv.EIGameInfo); len(names) > 0 {
+				s.log.Warnf("Ping reply of %s differs from its game info in %s",
+					srv, strings.Join(names, ", "))
+			}
+		}
+	} else {
+		s.metrics.pingReplies.Inc("unknown")
+	}
+
+	s.pinger.mu.Lock()
+	defer s.pinger.mu.Unlock()
+	if _, ok := s.pinger.targets[result.addr.String()]; ok {
+		s.pinger.replies[result.id] = captured
+	}
+}
+
+// apiPingReply is the response of the admin API with the last ping reply.
+type apiPingReply struct {
+	ID          uint64            `json:"id"`
+	Addr        string            `json:"addr"`
+	Time        time.Time         `json:"time"`
+	Size        int               `json:"size"`
+	HexDump     string            `json:"hex_dump"`
+	Reply       *master.PingReply `json:"reply,omitempty"`
+	DecodeError string            `json:"decode_error,omitempty"`
+	// Mismatches are fields of the decoded reply which differ from the
+	// registered game info.
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+func (s *Server) servePingReply(w http.ResponseWriter, req *http.Request) {
+	idStr := path.Base(req.URL.Path)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("invalid server ID %q", idStr)})
+		return
+	}
+	s.pinger.mu.Lock()
+	captured := s.pinger.replies[id]
+	s.pinger.mu.Unlock()
+	if captured == nil {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: fmt.Sprintf("no ping reply of server %d", id)})
+		return
+	}
+
+	resp := apiPingReply{
+		ID:      id,
+		Addr:    captured.addr.String(),
+		Time:    captured.time,
+		Size:    len(captured.data),
+		HexDump: master.HexDump(captured.data),
+		Reply:   captured.reply,
+	}
+	if captured.err != nil && !errors.Is(captured.err, master.ErrUnknownReply) {
+		resp.DecodeError = captured.err.Error()
+	}
+	if srv := s.registry.Find(&master.EIServerInfo{ID: id}); srv != nil && captured.reply != nil {
+		resp.Mismatches = captured.reply.Mismatches(&srv.EIGameInfo)
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
@@ -0,0 +1,203 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestPingStats(t *testing.T) {
+	var stats master.PingStats
+	if stats.Ping() != 0 {
+		t.Errorf("Unanswered server has ping %d", stats.Ping())
+	}
+	stats.AddReply(100 * time.Millisecond)
+	stats.AddReply(200 * time.Millisecond)
+	stats.AddLoss()
+	if stats.RTT != 112.5 || stats.Jitter != 6.25 || stats.Loss != 0.125 ||
+		stats.Sent != 3 || stats.Received != 2 || stats.Ping() != 113 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// startTestGame sends the game from the returned socket. The game answers
+// pings with reply until the socket is closed.
+func startTestGame(t *testing.T, srv *Server, game *master.EIGameInfo, reply []byte) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var buf bytes.Buffer
+	master.WriteGameInfo(&buf, game.PlayerNames != nil, game)
+	if _, err := conn.WriteTo(buf.Bytes(), srv.pcs[0].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		data := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFrom(data)
+			if err != nil {
+				return
+			}
+			if bytes.Equal(data[:n], master.PingProbe) {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestPinger(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{
+		PingInterval:    time.Second,
+		PingMaxInterval: 8 * time.Second,
+		// Timeouts follow the fake clock which advances by a second.
+		PingTimeout: 1500 * time.Millisecond,
+	}})
+	game := startTestGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha"}, []byte{3, 0, 0, 0, 1})
+
+	var servers []master.EIServerInfo
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		servers = getJSONList(t, srv)
+		if len(servers) == 1 && servers[0].PingStats.Received >= 3 {
+			break
+		}
+	}
+	if len(servers) != 1 || servers[0].Ping <= 0 || servers[0].PingStats.Loss != 0 {
+		t.Fatalf("Server isn't pinged: %+v", servers)
+	}
+
+	// The game stops answering, so it's probed less often.
+	game.Close()
+	var target pingTarget
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		srv.pinger.mu.Lock()
+		target = *srv.pinger.targets[servers[0].Addr.String()]
+		srv.pinger.mu.Unlock()
+		if target.interval == 8*time.Second {
+			break
+		}
+	}
+	if target.interval != 8*time.Second || target.stats.Loss == 0 {
+		t.Errorf("Unexpected target of unreachable server: %+v", target)
+	}
+	if servers := getJSONList(t, srv); servers[0].PingStats.Loss == 0 || servers[0].Ping <= 0 {
+		t.Errorf("Loss isn't published: %+v", servers[0].PingStats)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{
+		PingTimeout: time.Hour,
+		VisibleFor:  24 * time.Hour,
+		ExpireAfter: 24 * time.Hour,
+	}})
+	game := startTestGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha"}, nil)
+	waitForServers(t, srv, clock, 1)
+	game.Close()
+
+	// The probe is pending until the timeout passes by the server clock.
+	clock.Advance(time.Minute)
+	if n := srv.metrics.pings.Value("timeout"); n != 0 {
+		t.Errorf("Probe is timed out before its timeout: %d", n)
+	}
+	clock.Advance(time.Hour)
+	clock.Advance(time.Second)
+	if n := srv.metrics.pings.Value("timeout"); n != 1 {
+		t.Errorf("Unexpected number of timeouts: %d", n)
+	}
+	if servers := getJSONList(t, srv); len(servers) != 1 || servers[0].PingStats.Loss == 0 {
+		t.Errorf("Timeout isn't published: %+v", servers)
+	}
+}
+
+func TestPingLateReply(t *testing.T) {
+	clock := newFakeClock()
+	srv := New(Options{Clock: clock, Config: Config{PingTimeout: time.Second}})
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8888}
+	target := &pingTarget{id: 1, addr: addr, interval: time.Second,
+		sentAt: time.Now(), deadline: clock.Now().Add(-time.Millisecond)}
+	srv.pinger.targets[addr.String()] = target
+
+	// The reply comes after the deadline, but before the refresh times the
+	// probe out.
+	result, ok := srv.probeAnswered(&addr)
+	if !ok || result.answered || result.stats.Received != 0 || result.stats.Loss == 0 {
+		t.Errorf("Late reply is answered: %v %+v", ok, result)
+	}
+	if n := srv.metrics.pings.Value("timeout"); n != 1 || !target.sentAt.IsZero() || target.interval != 2*time.Second {
+		t.Errorf("Late reply isn't accounted as loss: %d %+v", n, target)
+	}
+
+	target.sentAt, target.deadline = time.Now(), clock.Now().Add(time.Second)
+	if result, ok := srv.probeAnswered(&addr); !ok || !result.answered || result.stats.Received != 1 {
+		t.Errorf("Reply in time isn't answered: %v %+v", ok, result)
+	}
+}
+
+// failingPacketConn fails to send anything.
+type failingPacketConn struct {
+	net.PacketConn
+}
+
+func (failingPacketConn) WriteTo([]byte, net.Addr) (int, error) {
+	return 0, errors.New("network is unreachable")
+}
+
+func TestPingSendError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, PingConn: failingPacketConn{conn}})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha"})
+	servers := waitForServers(t, srv, clock, 1)
+	if servers[0].PingStats.Loss == 0 || srv.metrics.pings.Value("error") == 0 {
+		t.Errorf("Failed probe isn't accounted: %+v", servers[0].PingStats)
+	}
+}
+
+func TestPingReply(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	var reply bytes.Buffer
+	reply.Write(master.PingProbe)
+	master.WriteGameInfo(&reply, false, &master.EIGameInfo{ClientID: 1, Name: "Beta", MaxPlayersCount: 8})
+	startTestGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", MaxPlayersCount: 8}, reply.Bytes())
+	servers := waitForServers(t, srv, clock, 1)
+
+	var resp apiPingReply
+	for i := 0; i < 100 && resp.Reply == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		srv.servePingReply(w, httptest.NewRequest("GET", fmt.Sprintf("/pings/%d", servers[0].ID), nil))
+		json.Unmarshal(w.Body.Bytes(), &resp)
+	}
+	if resp.Reply == nil || resp.Reply.Layout != "gameinfo" || resp.Reply.Fields["name"] != "Beta" ||
+		!reflect.DeepEqual(resp.Mismatches, []string{"name"}) || resp.Size != reply.Len() {
+		t.Errorf("Unexpected ping reply: %+v", resp)
+	}
+	if n := srv.metrics.pingReplies.Value("gameinfo"); n != 1 {
+		t.Errorf("Unexpected number of decoded replies: %d", n)
+	}
+
+	if _, err := master.DecodePingReply([]byte{3, 0, 0, 0, 1}); !errors.Is(err, master.ErrUnknownReply) {
+		t.Errorf("Unexpected error of unknown reply: %v", err)
+	}
+}
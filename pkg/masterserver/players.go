@@ -0,0 +1,198 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Player presence index is built from nick lists sent by modified game
+// servers. It's refreshed by the maintainer from visible servers, so players
+// are online while they are listed by a visible server. Players are
+// forgotten after playerRetention, the index is saved to the state file if
+// the registry supports extras.
+
+const (
+	playerRetention   = 30 * 24 * time.Hour
+	playersStateExtra = "players"
+)
+
+// stateExtras is implemented by registries able to save extra data in their
+// state, see FileRegistry.
+type stateExtras interface {
+	StateExtra(name string) []byte
+	SetStateExtra(name string, data []byte)
+}
+
+// playerPresence tells where the player plays or played last time.
+type playerPresence struct {
+	Name           string    `json:"name"`
+	Online         bool      `json:"online"`
+	ServerID       uint64    `json:"server_id,omitempty"` // Current server if online
+	LastSeen       time.Time `json:"last_seen"`
+	LastServerID   uint64    `json:"last_server_id"`
+	LastServerName string    `json:"last_server_name"`
+	LastServerAddr string    `json:"last_server_addr"`
+}
+
+type playerIndex struct {
+	mu      sync.RWMutex
+	players map[string]*playerPresence // By lower case name
+}
+
+func newPlayerIndex() *playerIndex {
+	return &playerIndex{players: make(map[string]*playerPresence)}
+}
+
+// translit is used to find players regardless of the alphabet their names
+// are typed in.
+var translit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "h", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "sch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya",
+}
+
+// searchKey returns lower case Latin transliteration of the name.
+func searchKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if latin, ok := translit[r]; ok {
+			b.WriteString(latin)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// update marks players of visible servers online and the rest offline.
+func (idx *playerIndex) update(now time.Time, servers []master.EIServerInfo) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, p := range idx.players {
+		p.Online, p.ServerID = false, 0
+	}
+	for i := range servers {
+		srv := &servers[i]
+		for _, name := range srv.PlayerNames {
+			if name == "" {
+				continue
+			}
+			key := strings.ToLower(name)
+			p, ok := idx.players[key]
+			if !ok {
+				p = &playerPresence{}
+				idx.players[key] = p
+			}
+			*p = playerPresence{
+				Name:           name,
+				Online:         true,
+				ServerID:       srv.ID,
+				LastSeen:       now,
+				LastServerID:   srv.ID,
+				LastServerName: srv.Name,
+				LastServerAddr: srv.Addr.String(),
+			}
+		}
+	}
+	for key, p := range idx.players {
+		if now.Sub(p.LastSeen) > playerRetention {
+			delete(idx.players, key)
+		}
+	}
+}
+
+// find returns the player by case insensitive name. If there is no such
+// player, the only player with the same transliterated name is returned.
+func (idx *playerIndex) find(name string) *playerPresence {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if p, ok := idx.players[strings.ToLower(name)]; ok {
+		result := *p
+		return &result
+	}
+	var found *playerPresence
+	key := searchKey(name)
+	for _, p := range idx.players {
+		if searchKey(p.Name) == key {
+			if found != nil {
+				return nil
+			}
+			found = p
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	result := *found
+	return &result
+}
+
+// search returns players which transliterated names contain the query sorted
+// by name. All players are returned for the empty query.
+func (idx *playerIndex) search(query string, onlineOnly bool) []playerPresence {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	key := searchKey(query)
+	result := []playerPresence{}
+	for _, p := range idx.players {
+		if (!onlineOnly || p.Online) && strings.Contains(searchKey(p.Name), key) {
+			result = append(result, *p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (idx *playerIndex) encode() ([]byte, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(idx.players)
+	return buf.Bytes(), err
+}
+
+func (idx *playerIndex) decode(data []byte) error {
+	players := make(map[string]*playerPresence)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&players); err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.players = players
+	return nil
+}
+
+// loadPlayers restores the index from the state.
+func (s *Server) loadPlayers() {
+	extras, ok := s.registry.(stateExtras)
+	if !ok {
+		return
+	}
+	if data := extras.StateExtra(playersStateExtra); data != nil {
+		if err := s.players.decode(data); err != nil {
+			s.log.Errorf("Failed to load player index: %s", err)
+		}
+	}
+}
+
+// storePlayers puts the index to the state, it's saved with the next snapshot.
+func (s *Server) storePlayers() {
+	extras, ok := s.registry.(stateExtras)
+	if !ok {
+		return
+	}
+	data, err := s.players.encode()
+	if err != nil {
+		s.log.Errorf("Failed to save player index: %s", err)
+		return
+	}
+	extras.SetStateExtra(playersStateExtra, data)
+}
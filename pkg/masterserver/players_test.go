@@ -0,0 +1,152 @@
+package masterserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestPlayerIndex(t *testing.T) {
+	idx := newPlayerIndex()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServerInfo(1, "First", start)
+	srv.ID = 1
+	srv.PlayerNames = []string{"Зорро", "Hunter"}
+	idx.update(start, []master.EIServerInfo{*srv})
+
+	if p := idx.find("ZORRO"); p == nil || p.Name != "Зорро" || !p.Online || p.ServerID != 1 {
+		t.Errorf("Transliterated player isn't found: %+v", p)
+	}
+	if p := idx.find("hunter"); p == nil || p.LastServerName != "First" {
+		t.Errorf("Player isn't found: %+v", p)
+	}
+	if players := idx.search("ор", false); len(players) != 1 || players[0].Name != "Зорро" {
+		t.Errorf("Unexpected search result: %+v", players)
+	}
+
+	// Players not listed anymore are offline but remembered.
+	srv.PlayerNames = []string{"Hunter"}
+	idx.update(start.Add(time.Minute), []master.EIServerInfo{*srv})
+	if p := idx.find("зорро"); p == nil || p.Online || p.ServerID != 0 || p.LastServerID != 1 ||
+		!p.LastSeen.Equal(start) {
+		t.Errorf("Unexpected offline player: %+v", p)
+	}
+	if players := idx.search("", true); len(players) != 1 || players[0].Name != "Hunter" {
+		t.Errorf("Unexpected online players: %+v", players)
+	}
+
+	idx.update(start.Add(playerRetention+2*time.Minute), nil)
+	if players := idx.search("", false); len(players) != 0 {
+		t.Errorf("Old players aren't forgotten: %+v", players)
+	}
+}
+
+func TestPlayersState(t *testing.T) {
+	path := tempStatePath(t)
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newPlayerIndex()
+	srv := newTestServerInfo(1, "First", time.Now())
+	srv.PlayerNames = []string{"Hunter"}
+	idx.update(time.Now(), []master.EIServerInfo{*srv})
+	data, err := idx.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.SetStateExtra(playersStateExtra, data)
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err = NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	loaded := newPlayerIndex()
+	if err := loaded.decode(reg.StateExtra(playersStateExtra)); err != nil {
+		t.Fatal(err)
+	}
+	if p := loaded.find("Hunter"); p == nil || p.LastServerName != "First" {
+		t.Errorf("Player isn't restored: %+v", p)
+	}
+}
+
+func TestPlayersRestart(t *testing.T) {
+	// The file registry is given by options and StatePath is empty, as in
+	// cmd/master with registry "file".
+	path := tempStatePath(t)
+	openRegistry := func() *FileRegistry {
+		reg, err := NewFileRegistry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reg
+	}
+
+	clock := newFakeClock()
+	srv := runTestServer(t, Options{Clock: clock, Registry: openRegistry()})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayersCount: 1,
+		PlayerNames: []string{"Hunter"}})
+	waitForServers(t, srv, clock, 1)
+	// The index is refreshed by the next tick.
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	srv = startTestServer(t, Options{Clock: newFakeClock(), Registry: openRegistry()})
+	if p := srv.players.find("Hunter"); p == nil || p.LastServerName != "Alpha" {
+		t.Errorf("Player isn't restored after restart: %+v", p)
+	}
+}
+
+func TestPlayersAPI(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Alpha", PlayersCount: 2,
+		PlayerNames: []string{"Шаман", "Knight"}})
+	waitForServers(t, srv, clock, 1)
+	// The index is refreshed by the next tick.
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/players?q=sham&online=true", nil))
+	var page apiPlayersPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Players) != 1 || page.Players[0].Name != "Шаман" {
+		t.Errorf("Unexpected players: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/players/knight", nil))
+	var p playerPresence
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Name != "Knight" || !p.Online ||
+		p.LastServerName != "Alpha" {
+		t.Errorf("Unexpected player: %s", w.Body)
+	}
+
+	for url, code := range map[string]int{
+		"/api/v1/players/nobody":       404,
+		"/api/v1/players?online=maybe": 400,
+		"/api/v1/players?limit=5000":   400,
+	} {
+		w = httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != code {
+			t.Errorf("Unexpected status of %s: %d", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package masterserver
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Content policy is applied to names, quests and player names of every update
+// before it reaches the registry. Control and invisible characters are
+// removed, strings are limited in length and banned words are found as whole
+// words ignoring case, punctuation inside words and look-alike characters, e.g.
+// Cyrillic "о" or digit "0" for Latin "o". Latin letters are never folded, so
+// ordinary words aren't turned into other words. Depending on the policy action the update is
+// either rewritten, with banned words masked by asterisks, or rejected.
+
+const (
+	PolicyRewrite = "rewrite" // Strings violating the policy are fixed
+	PolicyReject  = "reject"  // Updates with strings violating the policy are dropped
+)
+
+// Violations of the policy, they are used as metric labels.
+const (
+	violationControl = "control"
+	violationLength  = "length"
+	violationWord    = "word"
+)
+
+// homoglyphs maps look-alike characters to the Latin letter they imitate.
+// Latin letters themselves must not be keys.
+var homoglyphs = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', '0': 'o', '1': 'i', '!': 'i', '|': 'i', '3': 'e',
+	'4': 'a', '@': 'a', '5': 's', '$': 's', '7': 't', '8': 'b',
+}
+
+// skeleton returns the form of runes in which look-alike characters are the
+// same. Punctuation and symbols are skipped. pos[i] is the index of the rune
+// skel[i] comes from.
+func skeleton(runes []rune) (skel []rune, pos []int) {
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		if h, ok := homoglyphs[r]; ok {
+			r = h
+		} else if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		skel = append(skel, r)
+		pos = append(pos, i)
+	}
+	return skel, pos
+}
+
+type contentPolicy struct {
+	action                     string
+	maxName, maxQuest, maxNick int
+	words                      [][]rune // Skeletons of banned words
+}
+
+func newContentPolicy(cfg *Config) *contentPolicy {
+	p := &contentPolicy{
+		action:   cfg.ContentPolicy,
+		maxName:  cfg.MaxNameLength,
+		maxQuest: cfg.MaxQuestLength,
+		maxNick:  cfg.MaxNickLength,
+	}
+	for _, word := range cfg.BannedWords {
+		if skel, _ := skeleton([]rune(word)); len(skel) > 0 {
+			p.words = append(p.words, skel)
+		}
+	}
+	return p
+}
+
+// sanitize returns the string fixed according to the policy and the
+// violations found. Strings longer than maxLen characters are truncated
+// unless maxLen is negative.
+func (p *contentPolicy) sanitize(str string, maxLen int) (string, []string) {
+	var violations []string
+	runes := make([]rune, 0, len(str))
+	for _, r := range str {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == unicode.ReplacementChar {
+			continue
+		}
+		runes = append(runes, r)
+	}
+	if len(runes) != len([]rune(str)) {
+		violations = append(violations, violationControl)
+	}
+	if maxLen >= 0 && len(runes) > maxLen {
+		runes = runes[:maxLen]
+		violations = append(violations, violationLength)
+	}
+
+	skel, pos := skeleton(runes)
+	masked := false
+	for _, word := range p.words {
+		for i := 0; i+len(word) <= len(skel); i++ {
+			end := i + len(word)
+			if runesEqual(skel[i:end], word) && (i == 0 || !isWordRune(runes[pos[i-1]])) &&
+				(end == len(skel) || !isWordRune(runes[pos[end]])) {
+				for j := pos[i]; j <= pos[end-1]; j++ {
+					runes[j] = '*'
+				}
+				masked = true
+			}
+		}
+	}
+	if masked {
+		violations = append(violations, violationWord)
+	}
+	return string(runes), violations
+}
+
+// isWordRune tells whether the rune continues a word, so a banned word next to
+// it is a part of another word. Look-alike symbols such as "!" don't.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func runesEqual(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) contentPolicy() *contentPolicy {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.policy
+}
+
+// applyPolicy sanitizes the strings of srv. It returns false if the update
+// must be dropped.
+func (s *Server) applyPolicy(srv *master.EIServerInfo) bool {
+	p := s.contentPolicy()
+	rewritten := false
+	check := func(field string, str *string, maxLen int) bool {
+		fixed, violations := p.sanitize(*str, maxLen)
+		if len(violations) == 0 {
+			return true
+		}
+		for _, v := range violations {
+			s.metrics.policyViolations.Inc(v)
+		}
+		if p.action == PolicyReject {
+			s.log.Warnf("Server %s is rejected by content policy: %s %q violates %s",
+				srv, field, *str, strings.Join(violations, ", "))
+			return false
+		}
+		s.log.Infof("Content policy rewrote %s %q of server %s to %q: %s",
+			field, *str, srv, fixed, strings.Join(violations, ", "))
+		*str = fixed
+		rewritten = true
+		return true
+	}
+
+	ok := check("name", &srv.Name, p.maxName) && check("quest", &srv.Quest, p.maxQuest)
+	for i := 0; ok && i < len(srv.PlayerNames); i++ {
+		ok = check("player name", &srv.PlayerNames[i], p.maxNick)
+	}
+	if !ok {
+		s.metrics.policyDecisions.Inc(PolicyReject)
+	} else if rewritten {
+		s.metrics.policyDecisions.Inc(PolicyRewrite)
+	}
+	return ok
+}
+
+// LoadWordList reads banned words from the file, one word or phrase per line.
+// Empty lines and lines starting with # are skipped.
+func LoadWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
@@ -0,0 +1,91 @@
+package masterserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestContentPolicy(t *testing.T) {
+	cfg := Config{MaxNameLength: 10, BannedWords: []string{"cheat", "плохо", "ass", "ii"}}
+	cfg.fillDefaults()
+	p := newContentPolicy(&cfg)
+	for _, tc := range []struct {
+		str, fixed string
+		violations []string
+	}{
+		{"Alpha", "Alpha", nil},
+		{"Al\x01ph\u200ba", "Alpha", []string{violationControl}},
+		{"Very long name", "Very long ", []string{violationLength}},
+		{"No Ch3@т", "No *****", []string{violationWord}},
+		{"c.h.e.a.t", "*********", []string{violationWord}},
+		{"ПЛ0Х0!", "*****!", []string{violationWord}},
+		{"\x7fcheat now", "***** now", []string{violationControl, violationWord}},
+		// Words containing banned ones and Latin letters alike others are kept.
+		{"cheating", "cheating", nil},
+		{"Classic", "Classic", nil},
+		{"ll game", "ll game", nil},
+		{"Big ass", "Big ***", []string{violationWord}},
+	} {
+		fixed, violations := p.sanitize(tc.str, cfg.MaxNameLength)
+		if fixed != tc.fixed || !reflect.DeepEqual(violations, tc.violations) {
+			t.Errorf("Unexpected sanitized %q: %q %v", tc.str, fixed, violations)
+		}
+	}
+	if fixed, _ := p.sanitize("Very long name", -1); fixed != "Very long name" {
+		t.Errorf("Length isn't unlimited: %q", fixed)
+	}
+}
+
+func TestContentPolicyServer(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock,
+		Config: Config{BannedWords: []string{"troll"}, MaxNickLength: 4}})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Tr0ll\x02 game",
+		PlayerNames: []string{"Shaman"}})
+	servers := waitForServers(t, srv, clock, 1)
+	if servers[0].Name != "***** game" || !reflect.DeepEqual(servers[0].PlayerNames, []string{"Sham"}) {
+		t.Errorf("Strings aren't rewritten: %+v", servers[0])
+	}
+	if n := srv.metrics.policyDecisions.Value(PolicyRewrite); n != 1 {
+		t.Errorf("Unexpected number of rewrites: %d", n)
+	}
+
+	cfg := srv.Config()
+	cfg.ContentPolicy = PolicyReject
+	if err := srv.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 2, Name: "TR0LL"})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 3, Name: "Beta"})
+	waitForServers(t, srv, clock, 2)
+	clock.Advance(time.Second)
+	if servers := getJSONList(t, srv); len(servers) != 2 {
+		t.Errorf("Update isn't rejected: %+v", servers)
+	}
+	if n := srv.metrics.policyDecisions.Value(PolicyReject); n != 1 {
+		t.Errorf("Unexpected number of rejects: %d", n)
+	}
+}
+
+func TestLoadWordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words")
+	if err := ioutil.WriteFile(path, []byte("# Comment\ncheat\n\n  bad word \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	words, err := LoadWordList(path)
+	if err != nil || !reflect.DeepEqual(words, []string{"cheat", "bad word"}) {
+		t.Errorf("Unexpected words: %q %v", words, err)
+	}
+}
+
+func TestEncodeWin1251(t *testing.T) {
+	if encoded := master.EncodeWin1251("Я😀b"); !bytes.Equal(encoded, []byte{0xdf, '?', 'b'}) {
+		t.Errorf("Unexpected encoded string: %x", encoded)
+	}
+}
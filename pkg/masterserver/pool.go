@@ -0,0 +1,53 @@
+package masterserver
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool runs tasks by a fixed number of workers. Tasks are queued to a
+// bounded queue, if it's full new tasks are dropped instead of waiting.
+type workerPool struct {
+	name  string
+	tasks chan func(ctx context.Context)
+}
+
+func newWorkerPool(name string, queueSize int) *workerPool {
+	return &workerPool{name: name, tasks: make(chan func(ctx context.Context), queueSize)}
+}
+
+// start runs workers until ctx is done. Tasks remaining in the queue are run
+// with the done ctx then, so they are able to release their resources.
+func (p *workerPool) start(ctx context.Context, workers int, wg *sync.WaitGroup) {
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case task := <-p.tasks:
+					task(ctx)
+				case <-ctx.Done():
+					for {
+						select {
+						case task := <-p.tasks:
+							task(ctx)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+// trySubmit queues the task. It returns false if the queue is full.
+func (p *workerPool) trySubmit(task func(ctx context.Context)) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,42 @@
+package masterserver
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool("test", 2)
+	release := make(chan struct{})
+	var ran sync.WaitGroup
+
+	// Nothing runs the tasks yet, so the third one doesn't fit to the queue
+	for i := 0; i < 2; i++ {
+		ran.Add(1)
+		if !pool.trySubmit(func(ctx context.Context) { <-release; ran.Done() }) {
+			t.Fatalf("Task %d isn't queued", i)
+		}
+	}
+	if pool.trySubmit(func(ctx context.Context) {}) {
+		t.Error("Task is queued to the full queue")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	pool.start(ctx, 1, &wg)
+	close(release)
+	ran.Wait()
+
+	cancel()
+	wg.Wait()
+
+	// Tasks remaining in the queue after shutdown are run with the done context
+	done := make(chan error, 1)
+	pool.trySubmit(func(ctx context.Context) { done <- ctx.Err() })
+	pool.start(ctx, 1, &wg)
+	wg.Wait()
+	if err := <-done; err == nil {
+		t.Error("Task is run with active context after shutdown")
+	}
+}
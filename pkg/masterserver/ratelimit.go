@@ -0,0 +1,138 @@
+package masterserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Eviction policies applied when the registry has reached MaxServers.
+const (
+	EvictOldest = "oldest" // Remove the server which hasn't been updated for the longest time
+	EvictReject = "reject" // Don't register new servers
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of events per key using token buckets.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of key. The bucket gets rate tokens per
+// second and holds up to burst tokens.
+func (l *rateLimiter) allow(key string, now time.Time, rate float64, burst int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * rate
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// cleanup removes buckets which are full by now, they are the same as new ones.
+func (l *rateLimiter) cleanup(now time.Time, rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// subnetKey returns /24 network for IPv4 addresses and /64 for IPv6 ones.
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// checkQuotas decides whether a new server may be registered. It returns the
+// reason of rejection or an empty string. Only servers registered on this
+// master count, peer and mirrored copies don't take their room. If the
+// registry is full and the eviction policy allows it, the oldest server which
+// isn't pinned is removed to free the room.
+func (s *Server) checkQuotas(newSrv *master.EIServerInfo, cfg *Config) string {
+	servers := s.registry.List(func(srv *master.EIServerInfo) bool {
+		return srv.Origin == "" && srv.Mirror == ""
+	})
+	s.moderation.apply(servers)
+	sameIP, sameSubnet := 0, 0
+	newSubnet := subnetKey(newSrv.Addr.IP)
+	var oldest *master.EIServerInfo
+	for i := range servers {
+		srv := &servers[i]
+		if srv.Addr.IP.Equal(newSrv.Addr.IP) {
+			sameIP++
+		}
+		if subnetKey(srv.Addr.IP) == newSubnet {
+			sameSubnet++
+		}
+		if srv.Pinned == 0 && (oldest == nil || srv.LastUpdate.Before(oldest.LastUpdate)) {
+			oldest = srv
+		}
+	}
+
+	if cfg.MaxServersPerIP > 0 && sameIP >= cfg.MaxServersPerIP {
+		return "ip_quota"
+	}
+	if cfg.MaxServersPerSubnet > 0 && sameSubnet >= cfg.MaxServersPerSubnet {
+		return "subnet_quota"
+	}
+	if cfg.MaxServers > 0 && len(servers) >= cfg.MaxServers {
+		if cfg.EvictionPolicy != EvictOldest || oldest == nil {
+			return "registry_full"
+		}
+		s.log.Infof("Registry is full, evicting server %s", oldest)
+		if _, err := s.registry.Remove(oldest.ID); err != nil {
+			s.log.Errorf("Failed to evict server %s: %s", oldest, err)
+			return "registry_full"
+		}
+		s.metrics.serversEvicted.Inc()
+		s.serverRemoved(oldest)
+	}
+	return ""
+}
+
+// checkCopyQuota decides whether a new copy from a peer or a mirror may be
+// stored. Copies don't count against quotas of local servers and are never
+// evicted for them, they only have the limit of their own.
+func (s *Server) checkCopyQuota(cfg *Config) string {
+	if cfg.MaxCopies <= 0 {
+		return ""
+	}
+	copies := s.registry.List(func(srv *master.EIServerInfo) bool {
+		return srv.Origin != "" || srv.Mirror != ""
+	})
+	if len(copies) >= cfg.MaxCopies {
+		return "copies_full"
+	}
+	return ""
+}
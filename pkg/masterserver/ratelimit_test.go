@@ -0,0 +1,146 @@
+package masterserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if !l.allow("a", now, 1, 3) {
+			t.Fatalf("Packet %d within burst isn't allowed", i)
+		}
+	}
+	if l.allow("a", now, 1, 3) {
+		t.Error("Packet over burst is allowed")
+	}
+	if !l.allow("b", now, 1, 3) {
+		t.Error("Packet from another source isn't allowed")
+	}
+	if !l.allow("a", now.Add(time.Second), 1, 3) {
+		t.Error("Bucket isn't refilled")
+	}
+
+	l.cleanup(now.Add(time.Minute), 1, 3)
+	if len(l.buckets) != 0 {
+		t.Errorf("Full buckets aren't removed: %d", len(l.buckets))
+	}
+}
+
+func TestSubnetKey(t *testing.T) {
+	if key := subnetKey(net.IPv4(192, 168, 1, 77)); key != "192.168.1.0/24" {
+		t.Errorf("Unexpected IPv4 subnet: %s", key)
+	}
+	if key := subnetKey(net.ParseIP("2001:db8:1:2:3::1")); key != "2001:db8:1:2::/64" {
+		t.Errorf("Unexpected IPv6 subnet: %s", key)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{
+		MaxServersPerIP: 2,
+		MaxServers:      3,
+		EvictionPolicy:  EvictReject,
+	}})
+
+	for i := 1; i <= 3; i++ {
+		sendGame(t, srv, &master.EIGameInfo{ClientID: uint32(i), Name: string(rune('A' + i))})
+	}
+	waitForServers(t, srv, clock, 2)
+	for i := 0; i < 100 && srv.metrics.serversRejected.Value("ip_quota") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.metrics.serversRejected.Value("ip_quota"); n != 1 {
+		t.Errorf("Unexpected number of rejected servers: %d", n)
+	}
+	if servers := getJSONList(t, srv); len(servers) != 2 {
+		t.Errorf("Quota per IP isn't applied: %+v", servers)
+	}
+}
+
+func TestEvictionKeepsPinned(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{
+		MaxServers:     2,
+		EvictionPolicy: EvictOldest,
+	}})
+
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Pinned"})
+	pinned := waitForServers(t, srv, clock, 1)[0]
+	if err := srv.moderation.setMark(pinned.ID, &serverMark{Pinned: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 2, Name: "Evicted"})
+	waitForServers(t, srv, clock, 2)
+
+	// The pinned server is the oldest one, but the next one is evicted.
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 3, Name: "New"})
+	for i := 0; i < 100 && srv.metrics.serversEvicted.Value() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers := waitForServers(t, srv, clock, 2)
+	if servers[0].Name != "Pinned" || servers[1].Name != "New" {
+		t.Errorf("Unexpected servers after eviction: %+v", servers)
+	}
+}
+
+func TestQuotasIgnoreCopies(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{
+		MaxServersPerIP: 1,
+		MaxServers:      1,
+		EvictionPolicy:  EvictOldest,
+	}})
+
+	// Copies from peers and upstream masters have the same address as the
+	// local server, but they neither take its room nor get evicted for it.
+	for _, copied := range []master.EIServerInfo{
+		{EIGameInfo: master.EIGameInfo{Name: "Peer"}, Origin: "peer", OriginID: 1},
+		{EIGameInfo: master.EIGameInfo{Name: "Mirrored"}, Mirror: "upstream:28004"},
+	} {
+		copied.Addr = net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 28005}
+		copied.LastUpdate = clock.Now().Add(-time.Second)
+		if _, err := srv.registry.Upsert(&copied); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "Local"})
+	servers := waitForServers(t, srv, clock, 3)
+	if n := srv.metrics.serversEvicted.Value(); n != 0 {
+		t.Errorf("Copies are evicted: %d, %+v", n, servers)
+	}
+}
+
+func TestQuotasAcceptCopies(t *testing.T) {
+	cfg := Config{MaxServersPerIP: 1, MaxServers: 1, EvictionPolicy: EvictOldest, MaxCopies: 1}
+	srv := New(Options{Clock: newFakeClock(), Config: cfg})
+	cfg = srv.Config()
+	local := newTestServerInfo(1, "Local", srv.clock.Now())
+	if _, err := srv.registry.Upsert(local); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local quotas are full, but copies from the same IP are stored
+	// without evicting the local server until their own limit is reached.
+	remote := *newTestServerInfo(1, "Remote", srv.clock.Now())
+	remote.Addr.Port++
+	remote.Origin, remote.OriginID = "peer", 1
+	another := remote
+	another.Name, another.OriginID = "Another", 2
+	another.Addr.Port++
+	srv.mergeRemote([]master.EIServerInfo{remote, another}, &cfg)
+
+	servers := srv.registry.Snapshot()
+	if len(servers) != 2 || servers[0].Name != "Local" || servers[1].Name != "Remote" {
+		t.Errorf("Unexpected servers after merge: %+v", servers)
+	}
+	if n := srv.metrics.serversRejected.Value("copies_full"); n != 1 {
+		t.Errorf("Unexpected number of rejected copies: %d", n)
+	}
+}
@@ -0,0 +1,135 @@
+package masterserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func (s *Server) handleServerInfo(ctx context.Context, pc net.PacketConn, addr net.Addr, data []byte) {
+	s.log.Debugf("Data recieved %d bytes from %s", len(data), addr)
+	s.metrics.udpPackets.Inc()
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr == nil {
+		s.log.Errorf("Failed to cast addr %s to UDPAddr", addr)
+		return
+	}
+
+	srv := master.EIServerInfo{
+		Addr:       master.NormalizeUDPAddr(udpAddr),
+		AppearTime: s.clock.Now(),
+		LastUpdate: s.clock.Now(),
+	}
+
+	r := bytes.NewReader(data)
+	err := master.ReadGameInfo(r, false, &srv.EIGameInfo)
+	if err != nil {
+		s.metrics.parseErrors.Inc()
+		s.log.Errorf("Failed to parse game info: %s, hex dump:\n%s",
+			err.Error(), master.HexDump(data))
+		return
+	}
+	if r.Len() > 0 {
+		// Some data remaining. Probably it's nicks
+		r.Reset(data)
+		err = master.ReadGameInfo(r, true, &srv.EIGameInfo)
+		if err != nil {
+			s.metrics.parseErrors.Inc()
+			s.log.Errorf("Failed to parse game info: %s, hex dump:\n%s",
+				err.Error(), master.HexDump(data))
+			return
+		}
+	}
+
+	s.metrics.gameUpdates.Inc(gameProtocol(&srv))
+	jsonData, _ := json.Marshal(&srv)
+	s.log.Infof("Received game from: %s", string(jsonData))
+
+	if !s.applyPolicy(&srv) {
+		s.metrics.udpDropped.Inc("content_policy")
+		return
+	}
+	if s.banned(&srv) {
+		s.metrics.udpDropped.Inc("banned")
+		return
+	}
+
+	if srv.IsSentByOrigGame() {
+		srv.TokenVerified = s.verifyToken(&srv)
+		strict := s.Config().StrictTokens
+		if srv.MasterToken == 0 || (strict && !srv.TokenVerified) {
+			hadToken := srv.MasterToken != 0
+			s.sendChallenge(pc, addr, &srv)
+			if strict {
+				// The entry is registered or updated once the game echoes the token.
+				if hadToken {
+					s.log.Warnf("Update from %s has unknown token, sending new one", &srv)
+					s.metrics.udpDropped.Inc("bad_token")
+				} else {
+					s.metrics.udpDropped.Inc("token_challenge")
+				}
+				return
+			}
+		}
+	}
+
+	select {
+	case s.updates <- &srv:
+	case <-ctx.Done():
+	}
+}
+
+// allowPacket checks the rate limit of the packet source.
+func (s *Server) allowPacket(addr net.Addr) bool {
+	cfg := s.Config()
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if cfg.PacketRate < 0 || !ok {
+		return true
+	}
+	return s.limiter.allow(udpAddr.IP.String(), s.clock.Now(), cfg.PacketRate, cfg.PacketBurst)
+}
+
+func (s *Server) serversReciever(ctx context.Context, pc net.PacketConn) error {
+	defer pc.Close()
+
+	s.log.Infof("Listening on udp:%s", pc.LocalAddr())
+
+	doneChan := make(chan error, 1)
+	go func() {
+		buffer := make([]uint8, 4096)
+		for {
+			n, addr, err := pc.ReadFrom(buffer)
+			if err != nil {
+				doneChan <- err
+				return
+			}
+
+			if !s.allowPacket(addr) {
+				s.metrics.udpDropped.Inc("rate_limit")
+				continue
+			}
+
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+			queued := s.packetPool.trySubmit(func(ctx context.Context) {
+				if ctx.Err() == nil {
+					s.handleServerInfo(ctx, pc, addr, data)
+				}
+			})
+			if !queued {
+				s.metrics.udpDropped.Inc("queue_full")
+				s.metrics.queueDropped.Inc(s.packetPool.name)
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-doneChan:
+		return err
+	}
+}
@@ -0,0 +1,153 @@
+package masterserver
+
+import (
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// Registry stores registered game servers. Implementations must be safe for
+// concurrent use. All methods work with copies, so neither arguments nor
+// results are retained or shared by the registry.
+type Registry interface {
+	// Upsert adds srv to the registry if srv.ID is 0 or there is no entry with
+	// such ID, otherwise it replaces the existing entry. The stored entry with
+	// assigned ID is returned.
+	Upsert(srv *master.EIServerInfo) (*master.EIServerInfo, error)
+	// Find returns the entry with the same ID as target. If target has no ID,
+	// the entry looking like the same game server is returned. Find returns
+	// nil if there is no such entry.
+	Find(target *master.EIServerInfo) *master.EIServerInfo
+	// List returns entries accepted by filter. All entries are returned if
+	// filter is nil.
+	List(filter func(srv *master.EIServerInfo) bool) []master.EIServerInfo
+	// Remove removes the entry with the given ID. It returns false if there
+	// is no such entry.
+	Remove(id uint64) (bool, error)
+	// Expire removes entries which haven't been updated since before and
+	// returns them.
+	Expire(before time.Time) ([]master.EIServerInfo, error)
+	// Snapshot returns all entries to persist them.
+	Snapshot() []master.EIServerInfo
+}
+
+func findServer(target *master.EIServerInfo, servList []*master.EIServerInfo) *master.EIServerInfo {
+	if target.ID != 0 {
+		for _, srv := range servList {
+			if srv.ID == target.ID {
+				return srv
+			}
+		}
+		return nil
+	}
+	// First try to find server with strict equality.
+	for _, srv := range servList {
+		if srv.StrictEquals(target) {
+			return srv
+		}
+	}
+	// Then try to find server with similar parameters.
+	for _, srv := range servList {
+		if srv.Equals(target) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// MemoryRegistry is a Registry keeping entries in memory only.
+type MemoryRegistry struct {
+	mu      sync.RWMutex
+	servers []*master.EIServerInfo
+	lastID  uint64
+}
+
+// NewMemoryRegistry creates an empty in-memory registry.
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{}
+}
+
+func (reg *MemoryRegistry) Upsert(srv *master.EIServerInfo) (*master.EIServerInfo, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.upsert(srv), nil
+}
+
+func (reg *MemoryRegistry) upsert(srv *master.EIServerInfo) *master.EIServerInfo {
+	srv = srv.Copy()
+	if srv.ID == 0 {
+		reg.lastID++
+		srv.ID = reg.lastID
+	} else if srv.ID > reg.lastID {
+		reg.lastID = srv.ID
+	}
+
+	if existingSrv := findServer(&master.EIServerInfo{ID: srv.ID}, reg.servers); existingSrv != nil {
+		*existingSrv = *srv
+	} else {
+		reg.servers = append(reg.servers, srv)
+	}
+	return srv.Copy()
+}
+
+func (reg *MemoryRegistry) Find(target *master.EIServerInfo) *master.EIServerInfo {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if srv := findServer(target, reg.servers); srv != nil {
+		return srv.Copy()
+	}
+	return nil
+}
+
+func (reg *MemoryRegistry) List(filter func(srv *master.EIServerInfo) bool) []master.EIServerInfo {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	result := make([]master.EIServerInfo, 0, len(reg.servers))
+	for _, srv := range reg.servers {
+		if filter == nil || filter(srv) {
+			result = append(result, *srv.Copy())
+		}
+	}
+	return result
+}
+
+func (reg *MemoryRegistry) Remove(id uint64) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.remove(id), nil
+}
+
+func (reg *MemoryRegistry) remove(id uint64) bool {
+	for i, srv := range reg.servers {
+		if srv.ID == id {
+			reg.servers = append(reg.servers[:i], reg.servers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (reg *MemoryRegistry) Expire(before time.Time) ([]master.EIServerInfo, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.expire(before), nil
+}
+
+func (reg *MemoryRegistry) expire(before time.Time) []master.EIServerInfo {
+	var expired []master.EIServerInfo
+	servers := make([]*master.EIServerInfo, 0, len(reg.servers))
+	for _, srv := range reg.servers {
+		if srv.LastUpdate.Before(before) {
+			expired = append(expired, *srv)
+		} else {
+			servers = append(servers, srv)
+		}
+	}
+	reg.servers = servers
+	return expired
+}
+
+func (reg *MemoryRegistry) Snapshot() []master.EIServerInfo {
+	return reg.List(nil)
+}
@@ -0,0 +1,121 @@
+package masterserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func newTestServerInfo(clientID uint32, name string, lastUpdate time.Time) *master.EIServerInfo {
+	return &master.EIServerInfo{
+		Addr:       net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(clientID)), Port: 28004},
+		EIGameInfo: master.EIGameInfo{ClientID: clientID, Name: name},
+		LastUpdate: lastUpdate,
+	}
+}
+
+func testRegistry(t *testing.T, reg Registry) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv1, err := reg.Upsert(newTestServerInfo(1, "First", now))
+	if err != nil || srv1.ID == 0 {
+		t.Fatalf("Upsert failed: %v, %+v", err, srv1)
+	}
+	srv2, _ := reg.Upsert(newTestServerInfo(2, "Second", now.Add(-time.Hour)))
+	if srv2.ID == srv1.ID {
+		t.Fatalf("Same ID for different servers: %d", srv1.ID)
+	}
+
+	// Update is found by its parameters even without ID.
+	upd := newTestServerInfo(1, "First", now.Add(time.Minute))
+	found := reg.Find(upd)
+	if found == nil || found.ID != srv1.ID {
+		t.Fatalf("Server isn't found: %+v", found)
+	}
+	upd.ID = found.ID
+	upd.Quest = "Updated"
+	reg.Upsert(upd)
+	if found := reg.Find(&master.EIServerInfo{ID: srv1.ID}); found == nil || found.Quest != "Updated" {
+		t.Errorf("Server isn't updated: %+v", found)
+	}
+
+	list := reg.List(func(srv *master.EIServerInfo) bool { return srv.Name == "Second" })
+	if len(list) != 1 || list[0].ID != srv2.ID {
+		t.Errorf("Unexpected filtered list: %+v", list)
+	}
+
+	expired, err := reg.Expire(now.Add(-time.Minute))
+	if err != nil || len(expired) != 1 || expired[0].ID != srv2.ID {
+		t.Errorf("Unexpected expired servers: %v, %+v", err, expired)
+	}
+
+	srv3, _ := reg.Upsert(newTestServerInfo(3, "Third", now))
+	if removed, err := reg.Remove(srv3.ID); !removed || err != nil {
+		t.Errorf("Server isn't removed: %v", err)
+	}
+	if removed, _ := reg.Remove(srv3.ID); removed {
+		t.Error("Server is removed twice")
+	}
+	if snapshot := reg.Snapshot(); len(snapshot) != 1 || snapshot[0].ID != srv1.ID {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewMemoryRegistry())
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := tempStatePath(t)
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRegistry(t, reg)
+
+	// Reopened registry has the same entries and doesn't reuse IDs.
+	reg2, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := reg2.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Quest != "Updated" {
+		t.Fatalf("Unexpected entries after reopening: %+v", snapshot)
+	}
+	srv, _ := reg2.Upsert(newTestServerInfo(3, "Third", time.Now()))
+	if srv.ID <= snapshot[0].ID {
+		t.Errorf("ID %d is reused", srv.ID)
+	}
+}
+
+func TestFileRegistryIDs(t *testing.T) {
+	path := tempStatePath(t)
+	now := time.Now()
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Upsert(newTestServerInfo(1, "First", now))
+	last, _ := reg.Upsert(newTestServerInfo(2, "Expired", now.Add(-time.Hour)))
+	reg.Expire(now.Add(-time.Minute))
+	reg.journal.Close()
+
+	// IDs of removed entries aren't reused after restart, whether the entry
+	// is removed in the journal or before the snapshot.
+	for i := 0; i < 2; i++ {
+		reg, err = NewFileRegistry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, _ := reg.Upsert(newTestServerInfo(3, "Next", now.Add(-time.Hour)))
+		if srv.ID <= last.ID {
+			t.Errorf("ID %d is reused after restart %d", srv.ID, i)
+		}
+		last = srv
+		reg.Expire(now.Add(-time.Minute))
+		if err := reg.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd
+// +build darwin dragonfly freebsd netbsd
+
+package masterserver
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,7 @@
+package masterserver
+
+import "golang.org/x/sys/unix"
+
+// SO_REUSEPORT is missing in syscall package for linux, and its value differs
+// between architectures.
+const soReusePort = unix.SO_REUSEPORT
@@ -0,0 +1,19 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd
+// +build linux darwin dragonfly freebsd netbsd
+
+package masterserver
+
+import "syscall"
+
+const reusePortSupported = true
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
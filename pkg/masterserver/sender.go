@@ -0,0 +1,102 @@
+package masterserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+	"github.com/ei-projects/eimaster/pkg/lzevil"
+)
+
+func (s *Server) sendServersInfo(conn net.Conn) {
+	defer conn.Close()
+	cfg := s.Config()
+	s.metrics.listRequests.Inc()
+
+	var data [4]byte
+	var clientID uint32
+	conn.SetReadDeadline(time.Now().Add(cfg.ClientIDTimeout))
+	_, err := io.ReadFull(conn, data[:])
+	if err != nil {
+		s.log.Warnf("Client %s hasn't sent its ID before requesting server list: %s",
+			conn.RemoteAddr(), err)
+	} else {
+		binary.Read(bytes.NewReader(data[:]), binary.LittleEndian, &clientID)
+	}
+
+	servList := s.visibleServers()
+	s.log.Infof("Client addr: %s id: %08X connected. Sending %d servers...\n",
+		conn.RemoteAddr(), clientID, len(servList))
+
+	reachableSince := s.clock.Now().Add(-cfg.VisibleFor)
+	for i := range servList {
+		// Tokens prove updates come from the game server, clients must not
+		// get them.
+		servList[i].MasterToken = 0
+		if addr, ok := gameAddr(&servList[i], reachableSince); ok {
+			servList[i].Addr = addr
+		}
+	}
+
+	// Serialize servers list
+	var buf1, buf2 bytes.Buffer
+	master.WriteServersListFunc(&buf1, false, servList, func(srv *master.EIServerInfo, err error) {
+		s.metrics.listSkipped.Inc()
+		s.log.Infof("Server %s isn't sent to %s: %s", srv, conn.RemoteAddr(), err)
+	})
+	w := lzevil.NewWriter(&buf2, buf1.Len())
+	w.Write(buf1.Bytes())
+
+	buf1.Reset()
+	binary.Write(&buf1, binary.LittleEndian, uint32(buf2.Len()+4))
+	buf1.Write(buf2.Bytes())
+
+	conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+	_, err = io.Copy(conn, &buf1)
+	if err != nil {
+		s.metrics.listSendErrors.Inc()
+		s.log.Warnf("Failed to send servers list to %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	// The game needs this delay for some reason... Test client works fine without it
+	time.Sleep(cfg.SendDelay)
+}
+
+func (s *Server) serversSender(ctx context.Context) error {
+	defer s.listener.Close()
+
+	s.log.Infof("Listening on tcp:%s", s.listener.Addr())
+
+	doneChan := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				doneChan <- err
+				return
+			}
+			queued := s.listPool.trySubmit(func(ctx context.Context) {
+				if ctx.Err() != nil {
+					conn.Close()
+					return
+				}
+				s.sendServersInfo(conn)
+			})
+			if !queued {
+				s.metrics.queueDropped.Inc(s.listPool.name)
+				conn.Close()
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-doneChan:
+		return err
+	}
+}
@@ -0,0 +1,483 @@
+// Package masterserver implements Evil Islands master server. It receives game
+// announcements over UDP, sends the compressed list of games over TCP and
+// optionally serves the same list as JSON over HTTP.
+package masterserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	golog "log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures a Server. Connections which are not provided are created
+// by Start using the corresponding addresses.
+type Options struct {
+	Addr       string // UDP and TCP address for the game protocol
+	HTTPAddr   string // HTTP address. Don't serve HTTP if empty and HTTPListener is nil
+	HTTPPrefix string // Prefix for HTTP handlers
+	StatePath  string // Path to state file. Registry is persisted by FileRegistry if set
+
+	// HistoryPath is the file player count history is saved to. History is
+	// kept in memory only if it's empty. Saving history requires the registry
+	// which persists IDs, i.e. StatePath or a FileRegistry. Tiers are DefaultHistoryTiers if nil.
+	HistoryPath  string
+	HistoryTiers []HistoryTier
+
+	PacketConn   net.PacketConn // Receives game announcements
+	Listener     net.Listener   // Accepts servers list requests
+	HTTPListener net.Listener   // Accepts HTTP requests
+	PingConn     net.PacketConn // Sends pings to game servers, see pinger.go
+
+	// Sizes of the worker pools and their queues. Packets and list requests
+	// which don't fit to the queues are dropped. PingQueue is the number of
+	// ping replies waiting for the maintainer. Zero means default.
+	PacketWorkers int
+	PacketQueue   int
+	ListWorkers   int
+	ListQueue     int
+	PingQueue     int
+
+	// UDPSockets is the number of UDP sockets bound to Addr with SO_REUSEPORT
+	// to spread receiving between CPUs. It's ignored if PacketConn is set.
+	UDPSockets int
+
+	// Admin endpoints such as /metrics are served on the separate listener if
+	// AdminAddr or AdminListener is set, otherwise they are served by HTTP and
+	// require AdminToken or, for peers, PeerToken.
+	AdminAddr     string
+	AdminListener net.Listener
+
+	// Masters this one exchanges its registry with, see federation.go. Peers
+	// are base URLs of their admin endpoints. PeerName identifies this master,
+	// it's the host name by default. Peers must use the same PeerToken if set.
+	PeerName  string
+	Peers     []string
+	PeerToken string
+
+	// ModerationPath is the file bans and server marks are saved to, they are
+	// kept in memory only if it's empty. Moderation actions are appended to
+	// AuditLogPath. Moderation endpoints are served with admin endpoints if
+	// AdminToken is set, see moderation.go.
+	ModerationPath string
+	AuditLogPath   string
+	AdminToken     string
+
+	// Mirrors are TCP addresses of upstream masters whose lists are copied
+	// to the registry, see mirror.go.
+	Mirrors []string
+
+	Config   Config   // Settings which can be changed later by SetConfig
+	Registry Registry // Storage of game servers. In-memory registry is used if nil
+	Clock    Clock
+	Logger   *logrus.Logger
+}
+
+// Server is a master server. It's created by New, started by Start and stopped
+// by Shutdown. Server owns all connections passed to it in Options and the
+// registry if it implements io.Closer.
+type Server struct {
+	opts     Options
+	log      *logrus.Logger
+	clock    Clock
+	registry Registry
+
+	pcs           []net.PacketConn
+	listener      net.Listener
+	httpListener  net.Listener
+	adminListener net.Listener
+	metrics       *serverMetrics
+	limiter       *rateLimiter
+	challenges    *tokenChallenges
+
+	packetPool  *workerPool
+	listPool    *workerPool
+	pingConn    net.PacketConn
+	pinger      *pinger
+	pingResults chan pingResult
+
+	updates chan *master.EIServerInfo
+
+	changes       *changeLog
+	peerSync      chan struct{}
+	remoteUpdates chan []master.EIServerInfo
+
+	mirrorSync    chan struct{}
+	mirrorUpdates chan mirrorList
+
+	events  *eventBus
+	history *history
+	players *playerIndex
+	shown   map[uint64]*master.EIServerInfo // Servers as they are published by events, used by the maintainer
+
+	moderation  *moderation
+	removals    chan removal
+	markChanges chan uint64
+
+	cfgMu      sync.RWMutex
+	cfg        Config
+	policy     *contentPolicy
+	cfgChanged chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	errMu  sync.Mutex
+	err    error
+}
+
+// New creates a server. Missing options are filled with defaults.
+func New(opts Options) *Server {
+	if opts.Addr == "" {
+		opts.Addr = ":28004"
+	}
+	if opts.HTTPPrefix == "" {
+		opts.HTTPPrefix = "/"
+	}
+	defaults := []struct {
+		val *int
+		def int
+	}{
+		{&opts.PacketWorkers, 8},
+		{&opts.PacketQueue, 1024},
+		{&opts.ListWorkers, 8},
+		{&opts.ListQueue, 128},
+		{&opts.PingQueue, 256},
+		{&opts.UDPSockets, 1},
+	}
+	for _, d := range defaults {
+		if *d.val <= 0 {
+			*d.val = d.def
+		}
+	}
+	if opts.PeerName == "" {
+		opts.PeerName, _ = os.Hostname()
+	}
+	opts.Config.fillDefaults()
+	if opts.Registry == nil {
+		opts.Registry = NewMemoryRegistry()
+	}
+	if opts.HistoryTiers == nil {
+		opts.HistoryTiers = DefaultHistoryTiers
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+
+	s := &Server{
+		opts:     opts,
+		log:      opts.Logger,
+		clock:    opts.Clock,
+		registry: opts.Registry,
+		updates:  make(chan *master.EIServerInfo, 100),
+		limiter:  newRateLimiter(),
+
+		challenges: newTokenChallenges(),
+
+		changes:       newChangeLog(),
+		peerSync:      make(chan struct{}, 1),
+		remoteUpdates: make(chan []master.EIServerInfo, 16),
+
+		mirrorSync:    make(chan struct{}, 1),
+		mirrorUpdates: make(chan mirrorList, 16),
+
+		events:  newEventBus(),
+		shown:   make(map[uint64]*master.EIServerInfo),
+		history: newHistory(opts.HistoryTiers),
+		players: newPlayerIndex(),
+
+		moderation:  newModeration(opts.ModerationPath, opts.AuditLogPath),
+		removals:    make(chan removal),
+		markChanges: make(chan uint64),
+
+		packetPool:  newWorkerPool("packets", opts.PacketQueue),
+		listPool:    newWorkerPool("lists", opts.ListQueue),
+		pinger:      newPinger(),
+		pingResults: make(chan pingResult, opts.PingQueue),
+
+		cfg:        opts.Config,
+		policy:     newContentPolicy(&opts.Config),
+		cfgChanged: make(chan struct{}, 1),
+	}
+	s.metrics = newServerMetrics(s)
+	return s
+}
+
+// Registry returns the registry of game servers used by the server.
+func (s *Server) Registry() Registry {
+	return s.registry
+}
+
+// Addr returns the address of the game protocol listener. It's valid after
+// successful Start.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// HTTPAddr returns the address of the HTTP listener or nil if HTTP isn't served.
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// AdminAddr returns the address of the admin listener or nil if admin endpoints
+// are served by HTTP listener.
+func (s *Server) AdminAddr() net.Addr {
+	if s.adminListener == nil {
+		return nil
+	}
+	return s.adminListener.Addr()
+}
+
+func (s *Server) listen() error {
+	var err error
+	s.listener = s.opts.Listener
+	s.httpListener, s.adminListener = s.opts.HTTPListener, s.opts.AdminListener
+	s.pingConn = s.opts.PingConn
+	if s.opts.PacketConn != nil {
+		s.pcs = []net.PacketConn{s.opts.PacketConn}
+	} else if err = s.listenUDP(); err != nil {
+		return err
+	}
+	if s.pingConn == nil {
+		if s.pingConn, err = net.ListenPacket("udp", ":0"); err != nil {
+			return fmt.Errorf("failed to listen udp for pings: %w", err)
+		}
+	}
+	if s.listener == nil {
+		if s.listener, err = net.Listen("tcp", s.opts.Addr); err != nil {
+			return fmt.Errorf("failed to listen on tcp addr %s: %w", s.opts.Addr, err)
+		}
+	}
+	if s.httpListener == nil && s.opts.HTTPAddr != "" {
+		if s.httpListener, err = net.Listen("tcp", s.opts.HTTPAddr); err != nil {
+			return fmt.Errorf("failed to listen on http addr %s: %w", s.opts.HTTPAddr, err)
+		}
+	}
+	if s.adminListener == nil && s.opts.AdminAddr != "" {
+		if s.adminListener, err = net.Listen("tcp", s.opts.AdminAddr); err != nil {
+			return fmt.Errorf("failed to listen on admin addr %s: %w", s.opts.AdminAddr, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) listenUDP() error {
+	if s.opts.UDPSockets == 1 {
+		pc, err := net.ListenPacket("udp", s.opts.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen udp:%s: %w", s.opts.Addr, err)
+		}
+		s.pcs = []net.PacketConn{pc}
+		return nil
+	}
+
+	if !reusePortSupported {
+		return errors.New("multiple UDP sockets require SO_REUSEPORT which is not supported")
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	addr := s.opts.Addr
+	for i := 0; i < s.opts.UDPSockets; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen udp:%s: %w", addr, err)
+		}
+		s.pcs = append(s.pcs, pc)
+		// Bind the rest sockets to the same port if it was chosen by system.
+		addr = pc.LocalAddr().String()
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	closers := []interface{ Close() error }{s.listener, s.httpListener, s.adminListener, s.pingConn}
+	for _, pc := range s.pcs {
+		closers = append(closers, pc)
+	}
+	for _, c := range closers {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// Start opens listeners and starts server workers. The server is stopped when
+// ctx is cancelled, when any of the workers fails or by Shutdown.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.opts.Config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if s.opts.StatePath != "" {
+		reg, err := OpenFileRegistry(s.opts.StatePath, s.registry)
+		if err != nil {
+			return err
+		}
+		s.registry = reg
+	}
+	// A file registry given by options has the state too.
+	s.loadPlayers()
+	if s.opts.HistoryPath != "" {
+		if _, ok := s.registry.(idKeeper); !ok {
+			s.closeRegistry()
+			return errors.New("history requires the registry persisting server IDs")
+		}
+		if err := s.history.load(s.opts.HistoryPath); err != nil {
+			s.closeRegistry()
+			return fmt.Errorf("failed to load history %s: %w", s.opts.HistoryPath, err)
+		}
+	}
+
+	_, keepMarks := s.registry.(idKeeper)
+	if !keepMarks && s.opts.ModerationPath != "" {
+		s.log.Warnf("Registry doesn't keep server IDs, marks of servers are dropped on restart")
+	}
+	if err := s.moderation.load(keepMarks); err != nil {
+		s.closeRegistry()
+		return fmt.Errorf("failed to load moderation file %s: %w", s.opts.ModerationPath, err)
+	}
+
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		s.closeRegistry()
+		return err
+	}
+
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.packetPool.start(s.ctx, s.opts.PacketWorkers, &s.wg)
+	s.listPool.start(s.ctx, s.opts.ListWorkers, &s.wg)
+	for _, pc := range s.pcs {
+		pc := pc
+		s.startWorker("Reciever", func(ctx context.Context) error {
+			return s.serversReciever(ctx, pc)
+		})
+	}
+	s.startWorker("Sender", s.serversSender)
+	s.startWorker("Pinger", s.pingReceiver)
+	if s.httpListener != nil {
+		s.startWorker("SenderJSON", func(ctx context.Context) error {
+			return s.serveHTTP(ctx, s.httpListener, s.Handler())
+		})
+	}
+	if s.adminListener != nil {
+		s.startWorker("Admin", func(ctx context.Context) error {
+			return s.serveHTTP(ctx, s.adminListener, s.AdminHandler())
+		})
+	}
+	if len(s.opts.Peers) > 0 {
+		s.startWorker("Peers", s.syncPeers)
+	}
+	if len(s.opts.Mirrors) > 0 {
+		s.startWorker("Mirrors", s.syncMirrors)
+	}
+	s.startWorker("Maintainer", s.maintainServerList)
+
+	s.log.Info("Server started")
+	return nil
+}
+
+func (s *Server) startWorker(name string, f func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := f(s.ctx)
+		if errors.Is(err, context.Canceled) {
+			s.log.Debugf("%s cancelled", name)
+		} else {
+			s.log.Errorf("%s failed: %s", name, err)
+			s.errMu.Lock()
+			if s.err == nil {
+				s.err = fmt.Errorf("%s failed: %w", name, err)
+			}
+			s.errMu.Unlock()
+			s.cancel()
+		}
+	}()
+}
+
+// errNotStarted is returned by requests to the server before Start.
+var errNotStarted = errors.New("server is not started")
+
+// Done returns a channel which is closed when the server is stopping. It's
+// nil before Start.
+func (s *Server) Done() <-chan struct{} {
+	return s.serverDone()
+}
+
+// Err returns the error of the first failed worker, if any.
+func (s *Server) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *Server) closeRegistry() error {
+	if c, ok := s.registry.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Shutdown stops the server and waits for its workers to finish. The registry
+// is closed, so the state is saved before Shutdown returns. If ctx expires
+// first, ctx.Err() is returned. Shutdown before Start returns errNotStarted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.ctx == nil {
+		return errNotStarted
+	}
+	s.log.Info("Server is stopping...")
+	s.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		if err := s.closeRegistry(); err != nil {
+			return fmt.Errorf("failed to close registry: %w", err)
+		}
+		s.log.Info("Server stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) serveHTTP(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	logWriter := s.log.Writer()
+	defer logWriter.Close()
+	server := http.Server{
+		ErrorLog:          golog.New(logWriter, "", 0),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	doneChan := make(chan error, 1)
+	go func() {
+		s.log.Infof("Listening on http:%s", listener.Addr())
+		doneChan <- server.Serve(listener)
+	}()
+
+	select {
+	case <-ctx.Done():
+		server.Shutdown(context.Background())
+		return ctx.Err()
+	case err := <-doneChan:
+		return err
+	}
+}
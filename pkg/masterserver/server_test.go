@@ -0,0 +1,294 @@
+package masterserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+	"github.com/ei-projects/eimaster/pkg/lzevil"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		ticks: make(chan time.Time),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.ticks}
+}
+
+// Advance moves the clock forward and waits until the maintainer gets the tick.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.ticks <- now
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t fakeTicker) Stop() {}
+
+func startTestServer(t *testing.T, opts Options) *Server {
+	srv := runTestServer(t, opts)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv
+}
+
+// runTestServer starts the server which must be shut down by the test.
+func runTestServer(t *testing.T, opts Options) *Server {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	opts.Addr = "127.0.0.1:0"
+	opts.Logger = logger
+	if opts.Clock == nil {
+		opts.Clock = newFakeClock()
+	}
+
+	pc, err := net.ListenPacket("udp", opts.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.PacketConn = pc
+
+	srv := New(opts)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func sendGame(t *testing.T, srv *Server, game *master.EIGameInfo) {
+	conn, err := net.Dial("udp", srv.pcs[0].LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	master.WriteGameInfo(&buf, game.PlayerNames != nil, game)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getJSONList(t *testing.T, srv *Server) []master.EIServerInfo {
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var servers []master.EIServerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func waitForServers(t *testing.T, srv *Server, clock *fakeClock, count int) []master.EIServerInfo {
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		if servers := getJSONList(t, srv); len(servers) == count {
+			return servers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Server list hasn't got %d servers", count)
+	return nil
+}
+
+func getTCPList(t *testing.T, srv *Server) []master.EIServerInfo {
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	binary.Write(conn, binary.LittleEndian, uint32(0xDEADBEEF))
+	var size uint32
+	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	var servers []master.EIServerInfo
+	if err := master.ReadServersList(lzevil.NewReader(conn), false, &servers); err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func TestServerLifecycle(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+
+	sendGame(t, srv, &master.EIGameInfo{
+		ClientID:        0xABBACAFE,
+		Name:            "Test server",
+		Quest:           "Test quest",
+		MaxPlayersCount: 8,
+		AllodIndex:      3,
+		PlayerNames:     []string{"player"},
+	})
+	servers := waitForServers(t, srv, clock, 1)
+	if servers[0].Name != "Test server" || servers[0].PlayerNames[0] != "player" {
+		t.Errorf("Unexpected server: %+v", servers[0])
+	}
+
+	servers = getTCPList(t, srv)
+	if len(servers) != 1 || servers[0].Quest != "Test quest" || servers[0].AllodIndex != 3 {
+		t.Errorf("Unexpected servers list: %+v", servers)
+	}
+
+	// The server is hidden after 2 minutes without updates
+	clock.Advance(srv.Config().VisibleFor + time.Second)
+	if servers := getJSONList(t, srv); len(servers) != 0 {
+		t.Errorf("Expired server is still visible: %+v", servers)
+	}
+}
+
+func TestServerNotStarted(t *testing.T) {
+	srv := New(Options{})
+	if done := srv.Done(); done != nil {
+		t.Errorf("Server is done before start")
+	}
+	if err := srv.Shutdown(context.Background()); err != errNotStarted {
+		t.Errorf("Unexpected shutdown before start: %v", err)
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	clock1, clock2 := newFakeClock(), newFakeClock()
+	srv1 := startTestServer(t, Options{Clock: clock1})
+	srv2 := startTestServer(t, Options{Clock: clock2})
+
+	sendGame(t, srv1, &master.EIGameInfo{ClientID: 1, Name: "First", PlayerNames: []string{}})
+	waitForServers(t, srv1, clock1, 1)
+	clock2.Advance(time.Second)
+	if servers := getJSONList(t, srv2); len(servers) != 0 {
+		t.Errorf("Second server has got servers of the first one: %+v", servers)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	srv := startTestServer(t, Options{})
+
+	if err := srv.SetConfig(Config{VisibleFor: time.Hour, ExpireAfter: time.Minute}); err == nil {
+		t.Error("Inconsistent config is applied")
+	}
+	if err := srv.SetConfig(Config{VisibleFor: 5 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := srv.Config()
+	if cfg.VisibleFor != 5*time.Minute || cfg.RefreshInterval != DefaultConfig().RefreshInterval {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+}
+
+func TestIPv6Servers(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock})
+	sendGame(t, srv, &master.EIGameInfo{ClientID: 1, Name: "IPv4"})
+	waitForServers(t, srv, clock, 1)
+
+	v6 := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 28005}
+	v4 := net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 28005}
+	for _, s := range []*master.EIServerInfo{
+		{Addr: v6, EIGameInfo: master.EIGameInfo{ClientID: 2, Name: "IPv6 only"}},
+		{Addr: v6, EIGameInfo: master.EIGameInfo{ClientID: 3, Name: "Dual-stack"},
+			Endpoints: []master.EIServerEndpoint{{Addr: v6}, {Addr: v4}}},
+	} {
+		s.LastUpdate = clock.Now()
+		if _, err := srv.registry.Upsert(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if servers := getJSONList(t, srv); len(servers) != 3 {
+		t.Errorf("IPv6 servers aren't listed in JSON: %+v", servers)
+	}
+	servers := getTCPList(t, srv)
+	if len(servers) != 2 || servers[1].Name != "Dual-stack" || servers[1].Addr.String() != v4.String() {
+		t.Errorf("Unexpected servers list: %+v", servers)
+	}
+	if n := srv.metrics.listSkipped.Value(); n != 1 {
+		t.Errorf("Unexpected number of skipped servers: %d", n)
+	}
+
+	mapped := net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 28005}
+	if addr := master.NormalizeUDPAddr(&mapped); len(addr.IP) != net.IPv4len || addr.String() != v4.String() {
+		t.Errorf("Unexpected normalized address: %#v", addr)
+	}
+}
+
+func TestPublicAdminEndpoints(t *testing.T) {
+	get := func(handler http.Handler, url, token string) int {
+		req := httptest.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Without tokens admin endpoints are served only by the admin handler.
+	srv := startTestServer(t, Options{})
+	for _, url := range []string{"/metrics", "/pings/1", "/peer/delta"} {
+		if code := get(srv.Handler(), url, ""); code != http.StatusForbidden {
+			t.Errorf("Public %s is served without token: %d", url, code)
+		}
+	}
+	if code := get(srv.AdminHandler(), "/metrics", ""); code != http.StatusOK {
+		t.Errorf("Admin handler doesn't serve metrics: %d", code)
+	}
+
+	srv = startTestServer(t, Options{AdminToken: "admin", PeerToken: "peer"})
+	for _, tc := range []struct {
+		url, token string
+		code       int
+	}{
+		{"/metrics", "admin", http.StatusOK},
+		{"/metrics", "peer", http.StatusUnauthorized},
+		{"/pings/1", "admin", http.StatusNotFound},
+		{"/pings/1", "", http.StatusUnauthorized},
+		{"/peer/delta", "peer", http.StatusOK},
+		{"/peer/delta", "admin", http.StatusUnauthorized},
+	} {
+		if code := get(srv.Handler(), tc.url, tc.token); code != tc.code {
+			t.Errorf("Unexpected status of %s with token %q: %d", tc.url, tc.token, code)
+		}
+	}
+}
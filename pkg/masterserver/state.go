@@ -0,0 +1,176 @@
+package masterserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// State file starts with stateMagic followed by the format version. Files
+// without the magic are written by older versions as a plain GOB encoded list
+// of servers, they are treated as version 0.
+const (
+	stateMagic        = "EISTATE\x00"
+	stateVersion      = 2
+	maxJournalRecSize = 1024 * 1024
+)
+
+var errCorruptedJournal = errors.New("corrupted journal record")
+
+// stateV2 has extra sections of data kept by the server along with the
+// registry, e.g. the player presence index. LastID is the greatest ID ever
+// assigned, so IDs of removed entries aren't given out again. It's zero in
+// files written before it was added.
+type stateV2 struct {
+	Servers []master.EIServerInfo
+	Extras  map[string][]byte
+	LastID  uint64
+}
+
+const (
+	journalUpsert uint8 = iota + 1
+	journalExpire
+	journalRemove
+)
+
+type journalRecord struct {
+	Op     uint8
+	Server master.EIServerInfo // For journalUpsert
+	Before time.Time           // For journalExpire
+	ID     uint64              // For journalRemove
+}
+
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Make the rename durable. Not every platform allows to sync directories,
+	// so the error is ignored.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func saveState(path string, state *stateV2) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, stateMagic); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(stateVersion)); err != nil {
+			return err
+		}
+		return gob.NewEncoder(w).Encode(state)
+	})
+}
+
+// loadState reads the state file and returns it converted to the current
+// format with the version of the file format. Missing file is not an error,
+// there are just no servers.
+func loadState(path string) (*stateV2, uint32, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &stateV2{}, stateVersion, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(stateMagic)) {
+		// Version 0: just the list of servers.
+		var servers []master.EIServerInfo
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&servers); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode state of version 0: %w", err)
+		}
+		return &stateV2{Servers: servers}, 0, nil
+	}
+
+	r := bytes.NewReader(data[len(stateMagic):])
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, 0, fmt.Errorf("failed to read state version: %w", err)
+	}
+	if version != stateVersion {
+		return nil, 0, fmt.Errorf("unsupported state version %d", version)
+	}
+	var state stateV2
+	if err := gob.NewDecoder(r).Decode(&state); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode state of version %d: %w", version, err)
+	}
+	return &state, version, nil
+}
+
+// Journal is a sequence of records: uint32 length, uint32 CRC32 of the data
+// and the GOB encoded journalRecord. Every record is encoded separately to be
+// able to append records to the journal written by another process.
+func writeJournalRecord(w io.Writer, rec *journalRecord) error {
+	var data bytes.Buffer
+	data.Write(make([]byte, 8))
+	if err := gob.NewEncoder(&data).Encode(rec); err != nil {
+		return err
+	}
+	buf := data.Bytes()
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)-8))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readJournalRecord(r io.Reader, rec *journalRecord) (int, error) {
+	var header [8]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n > 0 {
+			return 0, errCorruptedJournal
+		}
+		return 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:])
+	if size > maxJournalRecSize {
+		return 0, errCorruptedJournal
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, errCorruptedJournal
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:]) {
+		return 0, errCorruptedJournal
+	}
+	*rec = journalRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return 0, errCorruptedJournal
+	}
+	return len(header) + len(data), nil
+}
@@ -0,0 +1,117 @@
+package masterserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+func tempStatePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "eimaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "state")
+}
+
+func TestStateMigration(t *testing.T) {
+	path := tempStatePath(t)
+
+	// This is how the state was saved before it got versioned.
+	legacy := []*master.EIServerInfo{newTestServerInfo(1, "Legacy", time.Now())}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	if snapshot := reg.Snapshot(); len(snapshot) != 1 || snapshot[0].Name != "Legacy" || snapshot[0].ID == 0 {
+		t.Errorf("Unexpected migrated entries: %+v", snapshot)
+	}
+
+	state, version, err := loadState(path)
+	if err != nil || version != stateVersion || len(state.Servers) != 1 {
+		t.Errorf("State isn't migrated: version %d, %v, %+v", version, err, state)
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	path := tempStatePath(t)
+
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	reg.Upsert(newTestServerInfo(1, "First", now))
+	reg.SaveSnapshot()
+	reg.Upsert(newTestServerInfo(2, "Second", now))
+	reg.Upsert(newTestServerInfo(3, "Expired", now.Add(-time.Hour)))
+	reg.Expire(now.Add(-time.Minute))
+	// Simulate crash in the middle of the journal write.
+	reg.journal.Write([]byte{0x10, 0, 0, 0, 1, 2})
+	reg.journal.Close()
+
+	reg, err = NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := reg.Snapshot()
+	if len(snapshot) != 2 || snapshot[0].Name != "First" || snapshot[1].Name != "Second" {
+		t.Errorf("Unexpected recovered entries: %+v", snapshot)
+	}
+
+	// The broken tail is cut, so new records are readable after it.
+	reg.Upsert(newTestServerInfo(4, "Fourth", now))
+	reg.journal.Close()
+	reg, err = NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	if snapshot := reg.Snapshot(); len(snapshot) != 3 {
+		t.Errorf("Unexpected entries after second recovery: %+v", snapshot)
+	}
+}
+
+func TestJournalWriteError(t *testing.T) {
+	path := tempStatePath(t)
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	srv, _ := reg.Upsert(newTestServerInfo(1, "First", now.Add(-time.Hour)))
+	reg.journal.Close()
+
+	// Changes which can't be journaled aren't applied.
+	if _, err := reg.Upsert(newTestServerInfo(2, "Second", now)); err == nil {
+		t.Error("Upsert succeeded without journal")
+	}
+	if expired, err := reg.Expire(now.Add(-time.Minute)); err == nil || len(expired) != 0 {
+		t.Errorf("Expire succeeded without journal: %+v", expired)
+	}
+	if removed, err := reg.Remove(srv.ID); err == nil || removed {
+		t.Error("Remove succeeded without journal")
+	}
+	if snapshot := reg.Snapshot(); len(snapshot) != 1 || snapshot[0].ID != srv.ID {
+		t.Errorf("Unexpected entries after failed changes: %+v", snapshot)
+	}
+	if lastID := reg.LastID(); lastID != srv.ID {
+		t.Errorf("ID %d of the failed upsert is taken", lastID)
+	}
+}
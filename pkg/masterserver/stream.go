@@ -0,0 +1,160 @@
+package masterserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Events are streamed by api/v1/events over Server-Sent Events or WebSocket
+// if the client asks for upgrade. The stream starts with the snapshot of
+// visible servers. Clients resume the stream by the ID of the last event got
+// in Last-Event-ID header or last_event_id parameter, they get the missed
+// events then instead of the snapshot if they are still kept.
+
+const streamHeartbeat = 15 * time.Second
+
+// openEventStream subscribes to events and returns the events to send first.
+func (s *Server) openEventStream(req *http.Request) (*eventSubscriber, []Event) {
+	lastIDStr := req.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = req.URL.Query().Get("last_event_id")
+	}
+	lastID, err := strconv.ParseUint(lastIDStr, 10, 64)
+	resume := lastIDStr != "" && err == nil
+
+	sub, missed, id, ok := s.events.subscribe(lastID, resume)
+	if ok {
+		return sub, missed
+	}
+	snapshot := Event{ID: id, Type: EventSnapshot, Time: s.clock.Now(), Servers: s.visibleServers()}
+	return sub, []Event{snapshot}
+}
+
+// serverDone returns the channel closed when the server stops. Handlers may
+// be used without starting the server, the channel is nil then.
+func (s *Server) serverDone() <-chan struct{} {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Done()
+}
+
+func (s *Server) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if isWebSocketRequest(req) {
+		s.serveEventsWebSocket(w, req)
+	} else {
+		s.serveEventsSSE(w, req)
+	}
+}
+
+func (s *Server) serveEventsSSE(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, first := s.openEventStream(req)
+	defer s.events.unsubscribe(sub)
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(event *Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err
+	}
+	for i := range first {
+		if err := writeEvent(&first[i]); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				// The client is too slow, it will reconnect and resume.
+				return
+			}
+			if err := writeEvent(&event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		case <-s.serverDone():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) serveEventsWebSocket(w http.ResponseWriter, req *http.Request) {
+	conn, err := upgradeWebSocket(w, req)
+	if err != nil {
+		s.log.Warnf("Failed to open websocket for %s: %s", req.RemoteAddr, err)
+		return
+	}
+	timeout := s.Config().WriteTimeout
+	defer conn.close(timeout)
+
+	sub, first := s.openEventStream(req)
+	defer s.events.unsubscribe(sub)
+
+	closed := make(chan struct{})
+	go func() {
+		conn.readLoop(timeout)
+		close(closed)
+	}()
+
+	writeEvent := func(event *Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.writeFrame(wsOpText, data, timeout)
+	}
+	for i := range first {
+		if err := writeEvent(&first[i]); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(&event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.writeFrame(wsOpPing, nil, timeout); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.serverDone():
+			return
+		}
+	}
+}
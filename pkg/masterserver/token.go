@@ -0,0 +1,131 @@
+package masterserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+// The original game sends updates without MasterToken until master server
+// replies with one, then it echoes the token in all updates. Only the host
+// the token was sent to knows it, so the token proves the update isn't spoofed.
+// Tokens are random by crypto/rand and they are never sent to clients. A token
+// is accepted only from the address it was sent to or from an endpoint of the
+// entry which has already echoed it. Other addresses get a fresh challenge.
+
+type challenge struct {
+	clientID uint32
+	addr     string
+	issued   time.Time
+}
+
+// tokenChallenges keeps tokens issued to game servers which aren't registered
+// with them yet.
+type tokenChallenges struct {
+	mu      sync.Mutex
+	pending map[uint32]challenge
+}
+
+func newTokenChallenges() *tokenChallenges {
+	return &tokenChallenges{pending: make(map[uint32]challenge)}
+}
+
+func (c *tokenChallenges) add(token, clientID uint32, addr *net.UDPAddr, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[token] = challenge{clientID: clientID, addr: addr.String(), issued: now}
+}
+
+func (c *tokenChallenges) has(token, clientID uint32, addr *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[token]
+	return ok && ch.clientID == clientID && ch.addr == addr.String()
+}
+
+// cleanup removes challenges issued before the given time.
+func (c *tokenChallenges) cleanup(before time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for token, ch := range c.pending {
+		if ch.issued.Before(before) {
+			delete(c.pending, token)
+		}
+	}
+}
+
+// newMasterToken returns a random non-zero token.
+func newMasterToken() (uint32, error) {
+	var data [4]byte
+	for {
+		if _, err := rand.Read(data[:]); err != nil {
+			return 0, err
+		}
+		if token := binary.LittleEndian.Uint32(data[:]); token != 0 {
+			return token, nil
+		}
+	}
+}
+
+// sendChallenge issues a new MasterToken to the game server.
+func (s *Server) sendChallenge(pc net.PacketConn, addr net.Addr, srv *master.EIServerInfo) {
+	token, err := newMasterToken()
+	if err != nil {
+		s.log.Errorf("Failed to generate password for %s: %s", srv, err)
+		return
+	}
+	srv.MasterToken = token
+	s.challenges.add(srv.MasterToken, srv.ClientID, &srv.Addr, s.clock.Now())
+	s.metrics.tokenChallenges.Inc()
+	s.log.Debugf("Sending password %08X to %s", srv.MasterToken, srv)
+	var buf bytes.Buffer
+	master.WriteMasterResponse(&buf, &srv.EIGameInfo)
+	pc.WriteTo(buf.Bytes(), addr)
+}
+
+// hasEndpoint checks the entry has received updates from addr.
+func hasEndpoint(e *master.EIServerInfo, addr *net.UDPAddr) bool {
+	return e.Addr.String() == addr.String() || e.Endpoint(addr) != nil
+}
+
+// verifyToken checks the token of srv has been issued by this server either
+// recently to the address of srv or to the registered entry which has
+// received it from the same address.
+func (s *Server) verifyToken(srv *master.EIServerInfo) bool {
+	if srv.MasterToken == 0 {
+		return false
+	}
+	if s.challenges.has(srv.MasterToken, srv.ClientID, &srv.Addr) {
+		return true
+	}
+	return len(s.registry.List(func(e *master.EIServerInfo) bool {
+		return e.TokenVerified && e.MasterToken == srv.MasterToken && e.ClientID == srv.ClientID &&
+			hasEndpoint(e, &srv.Addr)
+	})) > 0
+}
+
+// findExisting returns the entry the update belongs to. In strict mode only
+// verified updates may change verified entries and entries are matched by
+// exact address, never by similar parameters. A verified update is matched
+// by an endpoint of the entry, so a server which has passed the challenge from
+// another address gets an entry of its own.
+func (s *Server) findExisting(srv *master.EIServerInfo, cfg *Config) *master.EIServerInfo {
+	if !cfg.StrictTokens {
+		return s.registry.Find(srv)
+	}
+	matches := s.registry.List(func(e *master.EIServerInfo) bool {
+		if srv.TokenVerified {
+			return e.ClientID == srv.ClientID && hasEndpoint(e, &srv.Addr)
+		}
+		return !e.TokenVerified && e.StrictEquals(srv)
+	})
+	if len(matches) == 0 {
+		return nil
+	}
+	return &matches[0]
+}
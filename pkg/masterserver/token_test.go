@@ -0,0 +1,180 @@
+package masterserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	master "github.com/ei-projects/eimaster/pkg/eimasterlib"
+)
+
+type testGameConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialGame(t *testing.T, srv *Server) *testGameConn {
+	conn, err := net.Dial("udp", srv.pcs[0].LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testGameConn{t, conn}
+}
+
+func (c *testGameConn) send(game *master.EIGameInfo) {
+	var buf bytes.Buffer
+	master.WriteGameInfo(&buf, game.PlayerNames != nil, game)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// challenge sends the game without token and returns the token got in reply.
+func (c *testGameConn) challenge(game *master.EIGameInfo) uint32 {
+	game.MasterToken = 0
+	c.send(game)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 64)
+	n, err := c.conn.Read(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp := *game
+	if err := master.ReadMasterResponse(bytes.NewReader(data[:n]), &resp); err != nil {
+		c.t.Fatal(err)
+	}
+	return resp.MasterToken
+}
+
+func TestStrictTokens(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{StrictTokens: true}})
+	game := &master.EIGameInfo{ClientID: 0xABBACAFE, Name: "Victim", AllodIndex: 2}
+
+	// The game isn't registered until it echoes the token
+	victim := dialGame(t, srv)
+	token := victim.challenge(game)
+	clock.Advance(time.Second)
+	if servers := getJSONList(t, srv); len(servers) != 0 {
+		t.Fatalf("Server without token is registered: %+v", servers)
+	}
+	game.MasterToken = token
+	victim.send(game)
+	servers := waitForServers(t, srv, clock, 1)
+	if !servers[0].TokenVerified {
+		t.Errorf("Server isn't verified: %+v", servers[0])
+	}
+	victimAddr := servers[0].Addr.String()
+
+	// Spoofed updates with the same parameters don't change the entry
+	spoofer := dialGame(t, srv)
+	spoofed := &master.EIGameInfo{ClientID: 0xABBACAFE, Name: "Victim", AllodIndex: 2, PlayersCount: 5}
+	if newToken := spoofer.challenge(spoofed); newToken == token {
+		t.Error("Spoofer got the token of victim")
+	}
+	spoofed.MasterToken = token + 1
+	spoofer.send(spoofed)
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers = getJSONList(t, srv)
+	if len(servers) != 1 || servers[0].Addr.String() != victimAddr || servers[0].PlayersCount != 0 {
+		t.Errorf("Spoofed update has changed the server: %+v", servers)
+	}
+	if dropped := srv.metrics.udpDropped.Value("bad_token"); dropped != 1 {
+		t.Errorf("Unexpected number of updates with bad token: %d", dropped)
+	}
+
+	// Updates with the token are still accepted
+	game.PlayersCount = 3
+	victim.send(game)
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		servers = getJSONList(t, srv)
+		if len(servers) == 1 && servers[0].PlayersCount == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Verified update isn't applied: %+v", servers)
+}
+
+func TestTokenChallengeAddr(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{StrictTokens: true}})
+	game := &master.EIGameInfo{ClientID: 0xABBACAFE, Name: "Victim"}
+	token := dialGame(t, srv).challenge(game)
+
+	// The pending token is accepted only from the address it was sent to.
+	spoofed := *game
+	spoofed.MasterToken = token
+	dialGame(t, srv).send(&spoofed)
+	for i := 0; i < 100 && srv.metrics.udpDropped.Value("bad_token") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	if servers := getJSONList(t, srv); len(servers) != 0 {
+		t.Errorf("Token is accepted from another address: %+v", servers)
+	}
+	if dropped := srv.metrics.udpDropped.Value("bad_token"); dropped != 1 {
+		t.Errorf("Unexpected number of updates with bad token: %d", dropped)
+	}
+}
+
+func TestTokenReplay(t *testing.T) {
+	clock := newFakeClock()
+	srv := startTestServer(t, Options{Clock: clock, Config: Config{StrictTokens: true}})
+	game := &master.EIGameInfo{ClientID: 0xABBACAFE, Name: "Victim", AllodIndex: 2}
+	victim := dialGame(t, srv)
+	token := victim.challenge(game)
+	game.MasterToken = token
+	victim.send(game)
+	servers := waitForServers(t, srv, clock, 1)
+	victimAddr := servers[0].Addr.String()
+
+	// Clients don't get tokens
+	listed := getTCPList(t, srv)
+	if len(listed) != 1 || listed[0].MasterToken != 0 || listed[0].ClientID != game.ClientID {
+		t.Fatalf("Token is sent to clients: %+v", listed)
+	}
+
+	// The token of victim isn't accepted from another address, the spoofer
+	// gets a fresh challenge instead.
+	spoofer := dialGame(t, srv)
+	spoofed := &master.EIGameInfo{ClientID: 0xABBACAFE, Name: "Spoofer", AllodIndex: 2, MasterToken: token}
+	spoofer.send(spoofed)
+	spoofer.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 64)
+	n, err := spoofer.conn.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := *spoofed
+	if err := master.ReadMasterResponse(bytes.NewReader(data[:n]), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.MasterToken == token {
+		t.Error("Token is accepted from another address")
+	}
+	if dropped := srv.metrics.udpDropped.Value("bad_token"); dropped != 1 {
+		t.Errorf("Unexpected number of updates with bad token: %d", dropped)
+	}
+
+	// Passing the challenge registers the spoofer as a server of its own
+	spoofed.MasterToken = resp.MasterToken
+	spoofer.send(spoofed)
+	servers = waitForServers(t, srv, clock, 2)
+	for _, server := range servers {
+		if server.Name != "Victim" {
+			continue
+		}
+		if server.Addr.String() != victimAddr || len(server.Endpoints) != 1 || !server.TokenVerified {
+			t.Errorf("Replayed token has changed the server: %+v", server)
+		}
+		return
+	}
+	t.Errorf("Victim is lost: %+v", servers)
+}